@@ -1,8 +1,28 @@
 package main
 
+import (
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
 type apiConfig struct {
 	fileServerHits int
 	DB             *DB
-	JWTSecret      string
-	PolkaKey       string
+	Keys           *auth.KeySet
+	PasswordPolicy auth.PasswordPolicy
+	// PolkaKeys are every secret Polka may sign webhooks with
+	PolkaKeys           []string
+	PolkaReplays        *auth.ReplayCache
+	Mailer              Mailer
+	ChirpDeletionPolicy string
+	Blobs               BlobStore
+	ChirpUndoWindow     time.Duration
+	SubscriptionTerms   SubscriptionTerms
+	AccessDuration      time.Duration
+	RefreshDuration     time.Duration
+	FilterWords         []string
+	Entitlements        *EntitlementService
+	RateLimits          *RateLimiter
+	Webhooks            *WebhookSender
 }
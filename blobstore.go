@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore saves uploaded files and serves them back by key
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Delete(key string) error
+	http.Handler
+}
+
+// FileBlobStore keeps blobs as files in a single directory on disk
+type FileBlobStore struct {
+	root       string
+	fileServer http.Handler
+}
+
+// NewFileBlobStore creates the root directory if it doesn't exist
+func NewFileBlobStore(root string) (*FileBlobStore, error) {
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{
+		root:       root,
+		fileServer: http.FileServer(http.Dir(root)),
+	}, nil
+}
+
+func (bs *FileBlobStore) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", errors.New("invalid blob key")
+	}
+	return filepath.Join(bs.root, key), nil
+}
+
+// Put writes to a temporary file first so readers never see a partial blob
+func (bs *FileBlobStore) Put(key string, r io.Reader) error {
+	path, err := bs.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(bs.root, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (bs *FileBlobStore) Delete(key string) error {
+	path, err := bs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP serves a blob by key, without listing the directory
+func (bs *FileBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if _, err := bs.path(key); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	bs.fileServer.ServeHTTP(w, r)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const defaultConfigFilename = "chirpy.toml"
+const redacted = "[redacted]"
+
+// Config is the server's configuration. Each setting is layered, later sources
+// overriding earlier ones: defaults, the config file, the environment and flags
+type Config struct {
+	Port         string
+	FilepathRoot string
+	DBFilename   string
+	FilterWords  []string
+	MediaRoot    string
+	AdminEmail   string
+
+	AccessDuration  time.Duration
+	RefreshDuration time.Duration
+	JWTKeysFile     string
+	JWTAlg          string
+	JWTRotation     time.Duration
+
+	// PolkaKeys are every secret Polka may sign webhooks with
+	PolkaKeys         []string
+	SubscriptionTerms SubscriptionTerms
+
+	ChirpDeletionPolicy string
+	ChirpUndoWindow     time.Duration
+
+	WebhookAllowInsecure bool
+
+	PasswordMinLength     int
+	PasswordMinStrength   int
+	BreachedPasswordsFile string
+	Argon2Memory          int
+	Argon2Iterations      int
+	Argon2Parallelism     int
+
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	MailLog      string
+
+	// ConfigFile is the config file that was read, if any
+	ConfigFile string
+	settings   []*setting
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Port:                "8080",
+		FilepathRoot:        ".",
+		DBFilename:          "database.json",
+		FilterWords:         []string{"kerfuffle", "sharbert", "fornax"},
+		MediaRoot:           "media",
+		AccessDuration:      time.Hour,
+		RefreshDuration:     60 * 24 * time.Hour,
+		JWTKeysFile:         "jwt_keys.json",
+		JWTAlg:              auth.AlgEdDSA,
+		JWTRotation:         7 * 24 * time.Hour,
+		PolkaKeys:           []string{},
+		SubscriptionTerms:   SubscriptionTerms{Period: 30 * 24 * time.Hour, Grace: 3 * 24 * time.Hour},
+		ChirpDeletionPolicy: ChirpPolicyDelete,
+		ChirpUndoWindow:     5 * time.Minute,
+		PasswordMinLength:   auth.DefaultPasswordPolicy.MinLength,
+		PasswordMinStrength: auth.DefaultPasswordPolicy.MinStrength,
+		Argon2Memory:        int(auth.DefaultArgon2id.Memory),
+		Argon2Iterations:    int(auth.DefaultArgon2id.Iterations),
+		Argon2Parallelism:   int(auth.DefaultArgon2id.Parallelism),
+		SMTPPort:            "587",
+	}
+}
+
+// setting binds a Config field to its name in the config file and as a flag,
+// and to its environment variable
+type setting struct {
+	key    string
+	env    string
+	usage  string
+	secret bool
+	value  settingValue
+	// source is where the value came from: default, file, env or flag
+	source string
+}
+
+func (c *Config) bind() []*setting {
+	return []*setting{
+		{key: "port", env: "PORT", usage: "port to listen on", value: (*stringValue)(&c.Port)},
+		{key: "filepath_root", env: "FILEPATH_ROOT", usage: "directory served under /app/", value: (*stringValue)(&c.FilepathRoot)},
+		{key: "db_file", env: "DB_FILE", usage: "database file", value: (*stringValue)(&c.DBFilename)},
+		{key: "filter_words", env: "FILTER_WORDS", usage: "comma separated words masked in chirps", value: (*listValue)(&c.FilterWords)},
+		{key: "media_root", env: "MEDIA_ROOT", usage: "directory uploads are stored in", value: (*stringValue)(&c.MediaRoot)},
+		{key: "admin_email", env: "ADMIN_EMAIL", usage: "email of a user made admin at startup", value: (*stringValue)(&c.AdminEmail)},
+		{key: "access_token_minutes", env: "ACCESS_TOKEN_MINUTES", usage: "lifetime of access tokens", value: &periodValue{&c.AccessDuration, time.Minute}},
+		{key: "refresh_token_days", env: "REFRESH_TOKEN_DAYS", usage: "lifetime of sessions", value: &periodValue{&c.RefreshDuration, 24 * time.Hour}},
+		{key: "jwt_keys_file", env: "JWT_KEYS_FILE", usage: "file token signing keys are saved to", value: (*stringValue)(&c.JWTKeysFile)},
+		{key: "jwt_alg", env: "JWT_ALG", usage: "token signing algorithm, EdDSA or RS256", value: (*stringValue)(&c.JWTAlg)},
+		{key: "jwt_rotation_hours", env: "JWT_ROTATION_HOURS", usage: "how often the signing key is rotated", value: &periodValue{&c.JWTRotation, time.Hour}},
+		{key: "polka_keys", env: "POLKA_KEYS", usage: "comma separated secrets Polka signs webhooks with", secret: true, value: (*listValue)(&c.PolkaKeys)},
+		{key: "subscription_period_days", env: "SUBSCRIPTION_PERIOD_DAYS", usage: "how long a renewal extends a subscription when Polka doesn't say", value: &periodValue{&c.SubscriptionTerms.Period, 24 * time.Hour}},
+		{key: "subscription_grace_days", env: "SUBSCRIPTION_GRACE_DAYS", usage: "how long past due subscriptions are kept", value: &periodValue{&c.SubscriptionTerms.Grace, 24 * time.Hour}},
+		{key: "chirp_deletion_policy", env: "CHIRP_DELETION_POLICY", usage: "what happens to the chirps of deleted users, delete or anonymize", value: (*stringValue)(&c.ChirpDeletionPolicy)},
+		{key: "chirp_undo_minutes", env: "CHIRP_UNDO_MINUTES", usage: "how long deleted chirps can be restored", value: &periodValue{&c.ChirpUndoWindow, time.Minute}},
+		{key: "webhook_allow_insecure", env: "WEBHOOK_ALLOW_INSECURE", usage: "allow webhooks to plain http and private addresses", value: (*boolValue)(&c.WebhookAllowInsecure)},
+		{key: "password_min_length", env: "PASSWORD_MIN_LENGTH", usage: "shortest password allowed", value: (*intValue)(&c.PasswordMinLength)},
+		{key: "password_min_strength", env: "PASSWORD_MIN_STRENGTH", usage: "weakest password strength allowed, 0 to 4", value: (*intValue)(&c.PasswordMinStrength)},
+		{key: "breached_passwords_file", env: "BREACHED_PASSWORDS_FILE", usage: "file of passwords that may not be used", value: (*stringValue)(&c.BreachedPasswordsFile)},
+		{key: "argon2_memory_kib", env: "ARGON2_MEMORY_KIB", usage: "memory used to hash a password", value: (*intValue)(&c.Argon2Memory)},
+		{key: "argon2_iterations", env: "ARGON2_ITERATIONS", usage: "passes made to hash a password", value: (*intValue)(&c.Argon2Iterations)},
+		{key: "argon2_parallelism", env: "ARGON2_PARALLELISM", usage: "threads used to hash a password", value: (*intValue)(&c.Argon2Parallelism)},
+		{key: "smtp_host", env: "SMTP_HOST", usage: "SMTP server mail is sent through, mail is logged when unset", value: (*stringValue)(&c.SMTPHost)},
+		{key: "smtp_port", env: "SMTP_PORT", usage: "port of the SMTP server", value: (*stringValue)(&c.SMTPPort)},
+		{key: "smtp_username", env: "SMTP_USERNAME", usage: "SMTP username", value: (*stringValue)(&c.SMTPUsername)},
+		{key: "smtp_password", env: "SMTP_PASSWORD", usage: "SMTP password", secret: true, value: (*stringValue)(&c.SMTPPassword)},
+		{key: "mail_from", env: "MAIL_FROM", usage: "address mail is sent from", value: (*stringValue)(&c.MailFrom)},
+		{key: "mail_log", env: "MAIL_LOG", usage: "file mail is logged to when SMTP isn't set up", value: (*stringValue)(&c.MailLog)},
+	}
+}
+
+// LoadConfig layers the config file, the environment and the flags in args over
+// the defaults. The config file is --config, CHIRPY_CONFIG or chirpy.toml when it
+// exists. The config is returned with any errors, so it can still be printed
+func LoadConfig(flags *flag.FlagSet, args []string) (*Config, error) {
+	c := DefaultConfig()
+	c.settings = c.bind()
+	for _, s := range c.settings {
+		s.source = "default"
+	}
+
+	// flags are applied last, so they are only recorded while parsing
+	type flagArg struct {
+		setting *setting
+		value   string
+	}
+	flagArgs := []flagArg{}
+	for _, s := range c.settings {
+		record := func(value string) error {
+			flagArgs = append(flagArgs, flagArg{s, value})
+			return nil
+		}
+		if _, ok := s.value.(*boolValue); ok {
+			flags.BoolFunc(s.key, s.usage, record)
+		} else {
+			flags.Func(s.key, s.usage, record)
+		}
+	}
+	configFile := flags.String("config", "", "config file, "+defaultConfigFilename+" by default")
+	err := flags.Parse(args)
+	if err != nil {
+		return c, err
+	}
+
+	errs := []error{}
+	set := func(s *setting, source string, name string, value string) {
+		err := s.value.Set(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		s.source = source
+	}
+
+	file, err := c.readConfigFile(*configFile)
+	if err != nil {
+		return c, err
+	}
+	// sorted so the errors come in the same order every time
+	keys := make([]string, 0, len(file))
+	for key := range file {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.setting(key)
+		if s == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %s", c.ConfigFile, key))
+			continue
+		}
+		set(s, "file", c.ConfigFile+": "+key, file[key])
+	}
+
+	for _, s := range c.settings {
+		if value := os.Getenv(s.env); value != "" {
+			set(s, "env", s.env, value)
+		}
+	}
+	// POLKA_KEY is the single secret used before rotation was supported
+	if key := strings.TrimSpace(os.Getenv("POLKA_KEY")); key != "" {
+		c.PolkaKeys = append(c.PolkaKeys, key)
+		c.setting("polka_keys").source = "env"
+	}
+
+	for _, arg := range flagArgs {
+		set(arg.setting, "flag", "--"+arg.setting.key, arg.value)
+	}
+
+	errs = append(errs, c.validate()...)
+	return c, errors.Join(errs...)
+}
+
+// readConfigFile reads the settings in path, falling back to CHIRPY_CONFIG and
+// then chirpy.toml, which unlike the others may be missing
+func (c *Config) readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		path = os.Getenv("CHIRPY_CONFIG")
+	}
+	optional := path == ""
+	if optional {
+		path = defaultConfigFilename
+	}
+	data, err := os.ReadFile(path)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.ConfigFile = path
+	table := map[string]interface{}{}
+	_, err = toml.Decode(string(data), &table)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := map[string]string{}
+	err = flattenTOML(values, "", table)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// flattenTOML adds the values in table to values as they'd be set in the
+// environment, arrays comma separated. Keys under a [table] are prefixed with
+// its name, so smtp.host is read as smtp_host
+func flattenTOML(values map[string]string, prefix string, table map[string]interface{}) error {
+	for key, value := range table {
+		key = prefix + key
+		if nested, ok := value.(map[string]interface{}); ok {
+			err := flattenTOML(values, key+"_", nested)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// smtp_host and smtp.host are the same setting
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("%s is set twice", key)
+		}
+		switch value := value.(type) {
+		case string:
+			values[key] = value
+		case int64:
+			values[key] = strconv.FormatInt(value, 10)
+		case bool:
+			values[key] = strconv.FormatBool(value)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("%s: arrays may only hold strings", key)
+				}
+				items[i] = s
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("%s: unsupported value %v", key, value)
+		}
+	}
+	return nil
+}
+
+func (c *Config) setting(key string) *setting {
+	for _, s := range c.settings {
+		if s.key == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// validate returns every problem with the settings, so they can be fixed at once
+func (c *Config) validate() []error {
+	errs := []error{}
+	check := func(ok bool, key string, msg string) {
+		if !ok {
+			s := c.setting(key)
+			errs = append(errs, fmt.Errorf("%s (%s) %s", s.key, s.env, msg))
+		}
+	}
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port <= 65535, "port", "must be a port number")
+	check(c.DBFilename != "", "db_file", "must be set")
+	check(c.AccessDuration > 0, "access_token_minutes", "must be a positive number of minutes")
+	// rotated signing keys are only kept long enough to verify verification tokens
+	maxAccess := time.Duration(VerifyDuration) * time.Second
+	check(c.AccessDuration <= maxAccess, "access_token_minutes", fmt.Sprintf("must be at most %d, how long rotated signing keys are kept", maxAccess/time.Minute))
+	check(c.RefreshDuration > 0, "refresh_token_days", "must be a positive number of days")
+	check(c.JWTAlg == auth.AlgEdDSA || c.JWTAlg == auth.AlgRS256, "jwt_alg", "must be "+auth.AlgEdDSA+" or "+auth.AlgRS256)
+	check(c.JWTRotation > 0, "jwt_rotation_hours", "must be a positive number of hours")
+	check(keysFileUsable(c.JWTKeysFile), "jwt_keys_file", "must be a readable file, or a new file in an existing directory")
+	check(c.SubscriptionTerms.Period > 0, "subscription_period_days", "must be a positive number of days")
+	check(c.SubscriptionTerms.Grace >= 0, "subscription_grace_days", "must be a number of days")
+	check(c.ChirpDeletionPolicy == ChirpPolicyDelete || c.ChirpDeletionPolicy == ChirpPolicyAnonymize, "chirp_deletion_policy", "must be "+ChirpPolicyDelete+" or "+ChirpPolicyAnonymize)
+	check(c.ChirpUndoWindow >= 0, "chirp_undo_minutes", "must be a number of minutes")
+	maxLength := auth.DefaultPasswordPolicy.MaxLength
+	check(c.PasswordMinLength >= 1 && c.PasswordMinLength <= maxLength, "password_min_length", fmt.Sprintf("must be between 1 and %d", maxLength))
+	check(c.PasswordMinStrength >= 0 && c.PasswordMinStrength <= 4, "password_min_strength", "must be between 0 and 4")
+	check(c.Argon2Memory >= 1 && int64(c.Argon2Memory) <= math.MaxUint32, "argon2_memory_kib", "must be a positive number")
+	check(c.Argon2Iterations >= 1 && int64(c.Argon2Iterations) <= math.MaxUint32, "argon2_iterations", "must be a positive number")
+	check(c.Argon2Parallelism >= 1 && c.Argon2Parallelism <= math.MaxUint8, "argon2_parallelism", "must be between 1 and 255")
+	return errs
+}
+
+// keysFileUsable reports whether the signing keys can be loaded from path, or
+// saved to it when it doesn't exist yet. The keys themselves are checked when
+// they are loaded
+func keysFileUsable(path string) bool {
+	if path == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		dir, err := os.Stat(filepath.Dir(path))
+		return err == nil && dir.IsDir()
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// PasswordPolicy is the default policy with the configured limits
+func (c *Config) PasswordPolicy() (auth.PasswordPolicy, error) {
+	policy := auth.DefaultPasswordPolicy
+	policy.MinLength = c.PasswordMinLength
+	policy.MinStrength = c.PasswordMinStrength
+	if c.BreachedPasswordsFile != "" {
+		breached, err := auth.LoadBreachedPasswords(c.BreachedPasswordsFile)
+		if err != nil {
+			return policy, err
+		}
+		policy.Breached = breached
+	}
+	return policy, nil
+}
+
+// Argon2id is the default password hasher tuned by the configured costs
+func (c *Config) Argon2id() auth.Argon2idHasher {
+	hasher := auth.DefaultArgon2id
+	hasher.Memory = uint32(c.Argon2Memory)
+	hasher.Iterations = uint32(c.Argon2Iterations)
+	hasher.Parallelism = uint8(c.Argon2Parallelism)
+	return hasher
+}
+
+// Print writes the config in the config file format, noting where each setting
+// came from. Secrets are redacted
+func (c *Config) Print(w io.Writer) error {
+	if c.ConfigFile != "" {
+		fmt.Fprintf(w, "# read from %s\n", c.ConfigFile)
+	}
+	for _, s := range c.settings {
+		value := s.value.toml()
+		if s.secret && s.value.String() != "" {
+			value = strconv.Quote(redacted)
+		}
+		_, err := fmt.Fprintf(w, "%s = %s # %s (%s)\n", s.key, value, s.env, s.source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingValue is a flag.Value that can also be written to the config file
+type settingValue interface {
+	flag.Value
+	toml() string
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string { return string(*v) }
+func (v *stringValue) toml() string   { return strconv.Quote(string(*v)) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("must be a whole number")
+	}
+	*v = intValue(n)
+	return nil
+}
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) toml() string   { return v.String() }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("must be true or false")
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) toml() string   { return v.String() }
+
+// listValue is set from a comma separated list
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	*v = items
+	return nil
+}
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+func (v *listValue) toml() string {
+	items := make([]string, len(*v))
+	for i, item := range *v {
+		items[i] = strconv.Quote(item)
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+// periodValue is a duration set as a whole number of unit
+type periodValue struct {
+	d    *time.Duration
+	unit time.Duration
+}
+
+func (v *periodValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("must be a whole number")
+	}
+	*v.d = time.Duration(n) * v.unit
+	return nil
+}
+
+func (v *periodValue) String() string { return strconv.Itoa(int(*v.d / v.unit)) }
+func (v *periodValue) toml() string   { return v.String() }
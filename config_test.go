@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads the config with file as the config file and args as flags
+func loadTestConfig(t *testing.T, file string, args ...string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chirpy.toml")
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	flags := flag.NewFlagSet("chirpy", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return LoadConfig(flags, append([]string{"--config", path}, args...))
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	t.Setenv("REFRESH_TOKEN_DAYS", "")
+	c, err := loadTestConfig(t, `
+# overridden by PORT
+port = "8081"
+filter_words = ["kerfuffle", 'sharbert']
+refresh_token_days = 30
+webhook_allow_insecure = true
+
+[smtp]
+host = "smtp.example.com"
+`, "--access_token_minutes", "15")
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	if c.Port != "9090" {
+		t.Errorf("port = %q, want the environment's 9090", c.Port)
+	}
+	if want := []string{"kerfuffle", "sharbert"}; !reflect.DeepEqual(c.FilterWords, want) {
+		t.Errorf("filter_words = %q, want %q", c.FilterWords, want)
+	}
+	if c.RefreshDuration != 30*24*time.Hour || c.AccessDuration != 15*time.Minute || !c.WebhookAllowInsecure {
+		t.Errorf("config = %+v, want 30 day sessions, 15 minute access tokens and insecure webhooks", c)
+	}
+	if c.SMTPHost != "smtp.example.com" {
+		t.Errorf("smtp_host = %q, want it read from the [smtp] table", c.SMTPHost)
+	}
+	for key, want := range map[string]string{
+		"port":                 "env",
+		"filter_words":         "file",
+		"access_token_minutes": "flag",
+		"jwt_alg":              "default",
+	} {
+		if got := c.setting(key).source; got != want {
+			t.Errorf("%s came from %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestLoadConfigWithoutPolkaKeys(t *testing.T) {
+	t.Setenv("POLKA_KEYS", "")
+	t.Setenv("POLKA_KEY", "")
+	c, err := loadTestConfig(t, "")
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(c.PolkaKeys) != 0 {
+		t.Errorf("polka_keys = %q, want none", c.PolkaKeys)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		// want are the errors expected, in order
+		want []string
+	}{
+		{
+			name: "every problem in order",
+			file: `
+zeta = "unknown"
+alpha = "unknown"
+port = "none"
+refresh_token_days = "soon"
+`,
+			args: []string{"--jwt_alg", "HS256"},
+			want: []string{
+				"unknown setting alpha",
+				"refresh_token_days: must be a whole number",
+				"unknown setting zeta",
+				"port (PORT) must be a port number",
+				"jwt_alg (JWT_ALG) must be",
+			},
+		},
+		{
+			name: "access tokens outliving rotated keys",
+			args: []string{"--access_token_minutes", "1441"},
+			want: []string{"access_token_minutes (ACCESS_TOKEN_MINUTES) must be at most 1440"},
+		},
+		{
+			name: "setting and table key for the same setting",
+			file: "smtp_host = \"a.example.com\"\n[smtp]\nhost = \"b.example.com\"\n",
+			want: []string{"smtp_host is set twice"},
+		},
+		{
+			name: "array of numbers",
+			file: "filter_words = [1, 2]\n",
+			want: []string{"filter_words: arrays may only hold strings"},
+		},
+		{
+			name: "malformed TOML",
+			file: "port = \n",
+			want: []string{"chirpy.toml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PORT", "")
+			t.Setenv("JWT_ALG", "")
+			t.Setenv("REFRESH_TOKEN_DAYS", "")
+			t.Setenv("ACCESS_TOKEN_MINUTES", "")
+			_, err := loadTestConfig(t, tt.file, tt.args...)
+			if err == nil {
+				t.Fatal("LoadConfig accepted the config")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got %d errors, want %d:\n%s", len(lines), len(tt.want), err)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(lines[i], want) {
+					t.Errorf("error %d = %q, want it to mention %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigAccessTokenLimit(t *testing.T) {
+	t.Setenv("ACCESS_TOKEN_MINUTES", "")
+	c, err := loadTestConfig(t, "access_token_minutes = 1440\n")
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if c.AccessDuration != 24*time.Hour {
+		t.Errorf("access tokens last %s, want 24h", c.AccessDuration)
+	}
+}
+
+func TestLoadConfigKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "jwt_keys.json")
+	if err := os.WriteFile(existing, []byte("{}"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{name: "existing file", path: existing, ok: true},
+		{name: "new file", path: filepath.Join(dir, "new_keys.json"), ok: true},
+		{name: "unset", path: ""},
+		{name: "directory", path: dir},
+		{name: "missing directory", path: filepath.Join(dir, "missing", "jwt_keys.json")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_KEYS_FILE", "")
+			_, err := loadTestConfig(t, fmt.Sprintf("jwt_keys_file = %q\n", tt.path))
+			if tt.ok && err != nil {
+				t.Errorf("LoadConfig: %v", err)
+			}
+			if !tt.ok && (err == nil || !strings.Contains(err.Error(), "jwt_keys_file (JWT_KEYS_FILE) must be")) {
+				t.Errorf("LoadConfig: got %v, want jwt_keys_file rejected", err)
+			}
+		})
+	}
+}
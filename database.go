@@ -5,33 +5,90 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
+var ErrNotFound = errors.New("not found")
+var ErrForbidden = errors.New("forbidden")
+var ErrEmailTaken = errors.New("email is already in use")
+var ErrHandleTaken = errors.New("handle is already in use")
+var ErrInvalidMedia = errors.New("media not found")
+var ErrAlreadyVerified = errors.New("email is already verified")
+var ErrVerificationRecent = errors.New("a verification email was sent recently")
+var ErrInvalidVerification = errors.New("verification token is invalid or was already used")
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	// snapshot is the structure as last read or written, for the lookups made
+	// on every request. It is shared, so it must never be changed
+	snapshot *DBStructure
 }
 
 type DBStructure struct {
-	Chirps               map[int]Chirp        `json:"chirps"`
-	Users                map[int]User         `json:"users"`
-	EmailIDUserMap       map[string]int       `json:"emailIDUserMap"`
-	RevokedRefreshTokens map[string]time.Time `json:"revokedRefreshTokens"`
+	Chirps            map[int]Chirp              `json:"chirps"`
+	Users             map[int]User               `json:"users"`
+	EmailIDUserMap    map[string]int             `json:"emailIDUserMap"`
+	HandleIDUserMap   map[string]int             `json:"handleIDUserMap"`
+	RefreshTokens     map[string]RefreshToken    `json:"refreshTokens"`
+	Sessions          map[string]Session         `json:"sessions"`
+	Webhooks          map[string]Webhook         `json:"webhooks"`
+	WebhookDeliveries map[string]WebhookDelivery `json:"webhookDeliveries"`
+	PolkaEvents       map[string]PolkaEvent      `json:"polkaEvents"`
+	PasswordResets    map[string]PasswordReset   `json:"passwordResets"`
+	Media             map[string]Media           `json:"media"`
+	Blocks            relations                  `json:"blocks"`
+	AuditLog          []AuditEntry               `json:"auditLog"`
+	Mutes             relations                  `json:"mutes"`
+	LastUserID        int                        `json:"lastUserID"`
+	LastChirpID       int                        `json:"lastChirpID"`
 }
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	ID       int        `json:"id"`
+	Body     string     `json:"body"`
+	AuthorId int        `json:"author_id"`
+	MediaIDs []string   `json:"media_ids,omitempty"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// DeletedAt is set while a deleted chirp can still be restored
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Author is only filled in for responses
+	Author *AuthorSummary `json:"author,omitempty"`
 }
 
-type User struct {
+type AuthorSummary struct {
 	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+}
+
+type PasswordReset struct {
+	UserID    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type User struct {
+	ID       int    `json:"id"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// LegacyChirpyRed is the membership flag stored before subscriptions, moved into Subscription by backfill
+	LegacyChirpyRed bool `json:"is_chirpy_red,omitempty"`
+	IsVerified      bool `json:"is_verified"`
+	// VerifyTokenHash is the hash of the only verification token that can
+	// confirm Email, cleared once it's used or the email changes
+	VerifyTokenHash    string    `json:"verify_token_hash,omitempty"`
+	VerificationSentAt time.Time `json:"verification_sent_at"`
+	Handle             string    `json:"handle"`
+	DisplayName        string    `json:"display_name"`
+	Bio                string    `json:"bio"`
+	// Avatar is the blob key of the user's avatar image
+	Avatar       string         `json:"avatar"`
+	Role         string         `json:"role"`
+	TOTP         TOTPEnrollment `json:"totp"`
+	Subscription Subscription   `json:"subscription"`
 }
 
 // NewDB creates a new database connection
@@ -47,33 +104,42 @@ func NewDB(path string) (*DB, error) {
 
 func (db *DB) createDB() error {
 	dbStructure := DBStructure{
-		Chirps:               map[int]Chirp{},
-		Users:                map[int]User{},
-		EmailIDUserMap:       map[string]int{},
-		RevokedRefreshTokens: map[string]time.Time{},
+		Chirps:            map[int]Chirp{},
+		Users:             map[int]User{},
+		EmailIDUserMap:    map[string]int{},
+		HandleIDUserMap:   map[string]int{},
+		RefreshTokens:     map[string]RefreshToken{},
+		Sessions:          map[string]Session{},
+		Webhooks:          map[string]Webhook{},
+		WebhookDeliveries: map[string]WebhookDelivery{},
+		PolkaEvents:       map[string]PolkaEvent{},
+		PasswordResets:    map[string]PasswordReset{},
+		Media:             map[string]Media{},
+		Blocks:            relations{},
+		Mutes:             relations{},
 	}
 	return db.writeDB(dbStructure)
 }
 
 func (db *DB) CreateUser(email string, pwd string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-	if _, ok := dbStructure.EmailIDUserMap[email]; ok {
-		return User{}, fmt.Errorf("user with email %s already exists", email)
-	}
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.EmailIDUserMap[email]; ok {
+			return ErrEmailTaken
+		}
 
-	id := len(dbStructure.Users) + 1
-	user := User{
-		ID:          id,
-		Email:       email,
-		Password:    string(pwd),
-		IsChirpyRed: false,
-	}
-	dbStructure.Users[id] = user
-	dbStructure.EmailIDUserMap[email] = id
-	err = db.writeDB(dbStructure)
+		dbStructure.LastUserID++
+		id := dbStructure.LastUserID
+		user = User{
+			ID:         id,
+			Email:      email,
+			Password:   string(pwd),
+			IsVerified: false,
+		}
+		dbStructure.Users[id] = user
+		dbStructure.EmailIDUserMap[email] = id
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -81,27 +147,192 @@ func (db *DB) CreateUser(email string, pwd string) (User, error) {
 	return user, nil
 }
 
-func (db *DB) UpdateUser(id int, email string, pwd string) (User, error) {
-	dbStructure, err := db.loadDB()
+// UserChanges are the changes ChangeUser makes together, nil fields are left as they are
+type UserChanges struct {
+	Email         *string
+	PasswordHash  *string
+	Handle        *string
+	DisplayName   *string
+	Bio           *string
+	AvatarMediaID *string
+}
+
+// ChangeUser applies every change or, when one of them fails, none of them
+func (db *DB) ChangeUser(id int, changes UserChanges) (User, error) {
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user does not exists: %v", id)
+		}
+		var err error
+		if changes.Email != nil || changes.PasswordHash != nil {
+			email, pwd := user.Email, user.Password
+			if changes.Email != nil {
+				email = *changes.Email
+			}
+			if changes.PasswordHash != nil {
+				pwd = *changes.PasswordHash
+			}
+			user, err = dbStructure.setCredentials(id, email, pwd)
+			if err != nil {
+				return err
+			}
+		}
+		if changes.Handle != nil || changes.DisplayName != nil || changes.Bio != nil {
+			handle, displayName, bio := user.Handle, user.DisplayName, user.Bio
+			if changes.Handle != nil {
+				handle = *changes.Handle
+			}
+			if changes.DisplayName != nil {
+				displayName = *changes.DisplayName
+			}
+			if changes.Bio != nil {
+				bio = *changes.Bio
+			}
+			user, err = dbStructure.setProfile(id, handle, displayName, bio)
+			if err != nil {
+				return err
+			}
+		}
+		if changes.AvatarMediaID != nil {
+			user, err = dbStructure.setAvatar(id, *changes.AvatarMediaID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	u, ok := dbStructure.Users[id]
+	return user, nil
+}
+
+func (dbStructure DBStructure) setCredentials(id int, email string, pwd string) (User, error) {
+	user, ok := dbStructure.Users[id]
 	if !ok {
 		return User{}, fmt.Errorf("user does not exists: %v", id)
 	}
-	oldEmail := u.Email
+	oldEmail := user.Email
+	if ownerID, ok := dbStructure.EmailIDUserMap[email]; ok && ownerID != id {
+		return User{}, ErrEmailTaken
+	}
 	delete(dbStructure.EmailIDUserMap, oldEmail)
-	user := User{
-		ID:          id,
-		Email:       email,
-		Password:    string(pwd),
-		IsChirpyRed: u.IsChirpyRed,
+	user.Email = email
+	user.Password = pwd
+	if oldEmail != email {
+		user.IsVerified = false
+		user.VerifyTokenHash = ""
 	}
 	dbStructure.Users[id] = user
 	dbStructure.EmailIDUserMap[email] = id
-	err = db.writeDB(dbStructure)
+	return user, nil
+}
+
+// RehashPassword replaces the user's password hash with newHash, as long as it
+// is still oldHash and wasn't changed in the meantime
+func (db *DB) RehashPassword(id int, oldHash string, newHash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user does not exists: %v", id)
+		}
+		if user.Password != oldHash {
+			return errNoChange
+		}
+		user.Password = newHash
+		dbStructure.Users[id] = user
+		return nil
+	})
+}
+
+// setProfile sets the user's public profile. Handles are unique regardless of case
+func (dbStructure DBStructure) setProfile(id int, handle string, displayName string, bio string) (User, error) {
+	user, ok := dbStructure.Users[id]
+	if !ok {
+		return User{}, fmt.Errorf("user does not exists: %v", id)
+	}
+	handleKey := strings.ToLower(handle)
+	if ownerID, ok := dbStructure.HandleIDUserMap[handleKey]; ok && ownerID != id {
+		return User{}, ErrHandleTaken
+	}
+	if user.Handle != "" {
+		delete(dbStructure.HandleIDUserMap, strings.ToLower(user.Handle))
+	}
+	if handle != "" {
+		dbStructure.HandleIDUserMap[handleKey] = id
+	}
+	user.Handle = handle
+	user.DisplayName = displayName
+	user.Bio = bio
+	dbStructure.Users[id] = user
+	return user, nil
+}
+
+// SetVerificationToken stores the hash of a new verification token for email,
+// replacing any sent before. It fails when the email was already confirmed or
+// changed in the meantime, or when the last token was sent less than cooldown ago
+func (db *DB) SetVerificationToken(id int, email string, tokenHash string, cooldown time.Duration) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user does not exists: %v", id)
+		}
+		if user.Email != email {
+			return ErrInvalidVerification
+		}
+		if user.IsVerified {
+			return ErrAlreadyVerified
+		}
+		now := time.Now().UTC()
+		if now.Before(user.VerificationSentAt.Add(cooldown)) {
+			return ErrVerificationRecent
+		}
+		user.VerifyTokenHash = tokenHash
+		user.VerificationSentAt = now
+		dbStructure.Users[id] = user
+		return nil
+	})
+}
+
+// CancelVerificationToken forgets the verification token with tokenHash when
+// its email couldn't be sent, so the user can ask for another straight away.
+// A token sent since is left alone
+func (db *DB) CancelVerificationToken(id int, tokenHash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok || user.VerifyTokenHash != tokenHash {
+			return errNoChange
+		}
+		user.VerifyTokenHash = ""
+		user.VerificationSentAt = time.Time{}
+		dbStructure.Users[id] = user
+		return nil
+	})
+}
+
+// VerifyUser marks the user's email as confirmed when email is still theirs
+// and tokenHash is the hash of the last verification token sent to it. The
+// token can only be used once
+func (db *DB) VerifyUser(id int, email string, tokenHash string) (User, error) {
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if user.Email != email || user.VerifyTokenHash == "" || user.VerifyTokenHash != tokenHash {
+			return ErrInvalidVerification
+		}
+		user.IsVerified = true
+		user.VerifyTokenHash = ""
+		dbStructure.Users[id] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -109,51 +340,167 @@ func (db *DB) UpdateUser(id int, email string, pwd string) (User, error) {
 	return user, nil
 }
 
-func (db *DB) UpgradeUser(id int) (bool, error) {
+// DeleteUser removes the user and revokes their tokens. Their chirps are
+// deleted, or kept without an author or attachments when anonymizeChirps is
+// set. The user's uploads are returned so their blobs can be removed
+func (db *DB) DeleteUser(id int, anonymizeChirps bool) ([]Media, error) {
+	media := []Media{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user does not exists: %v", id)
+		}
+		delete(dbStructure.Users, id)
+		delete(dbStructure.EmailIDUserMap, user.Email)
+		if user.Handle != "" {
+			delete(dbStructure.HandleIDUserMap, strings.ToLower(user.Handle))
+		}
+		for hash, reset := range dbStructure.PasswordResets {
+			if reset.UserID == id {
+				delete(dbStructure.PasswordResets, hash)
+			}
+		}
+		dbStructure.revokeUserRefreshTokens(id)
+		dbStructure.removeRelations(id)
+		dbStructure.removeUserWebhooks(id)
+
+		for chirpID, chirp := range dbStructure.Chirps {
+			if chirp.AuthorId != id {
+				continue
+			}
+			if anonymizeChirps {
+				// chirps can only attach their author's uploads, which are deleted below
+				chirp.AuthorId = 0
+				chirp.MediaIDs = nil
+				dbStructure.Chirps[chirpID] = chirp
+			} else {
+				delete(dbStructure.Chirps, chirpID)
+			}
+		}
+
+		for mediaID, m := range dbStructure.Media {
+			if m.OwnerID == id {
+				media = append(media, m)
+				delete(dbStructure.Media, mediaID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+// CreatePasswordReset stores the hash of a reset token until it is used or expires
+func (db *DB) CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.PasswordResets[tokenHash] = PasswordReset{
+			UserID:    userID,
+			ExpiresAt: expiresAt,
+		}
+		return nil
+	})
+}
+
+// FindPasswordReset returns the user a reset token was issued to, if it is still valid
+func (db *DB) FindPasswordReset(tokenHash string) (User, error) {
 	dbStructure, err := db.loadDB()
 	if err != nil {
-		return false, err
+		return User{}, err
 	}
 
-	u, ok := dbStructure.Users[id]
-	if !ok {
-		return false, fmt.Errorf("user does not exists: %v", id)
+	reset, ok := dbStructure.PasswordResets[tokenHash]
+	if !ok || time.Now().UTC().After(reset.ExpiresAt) {
+		return User{}, ErrInvalidResetToken
 	}
-	user := User{
-		ID:          id,
-		Email:       u.Email,
-		Password:    u.Password,
-		IsChirpyRed: true,
+	user, ok := dbStructure.Users[reset.UserID]
+	if !ok {
+		return User{}, fmt.Errorf("user does not exists: %v", reset.UserID)
 	}
-	dbStructure.Users[id] = user
-	err = db.writeDB(dbStructure)
+	return user, nil
+}
+
+// ResetPassword consumes a reset token, sets the user's new password and
+// revokes every session and refresh token issued to them so far. The token is
+// checked and consumed under the write lock, so only one reset can use it
+func (db *DB) ResetPassword(tokenHash string, pwd string) (User, error) {
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		reset, ok := dbStructure.PasswordResets[tokenHash]
+		if !ok || time.Now().UTC().After(reset.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+		user, ok = dbStructure.Users[reset.UserID]
+		if !ok {
+			return fmt.Errorf("user does not exists: %v", reset.UserID)
+		}
+
+		user.Password = pwd
+		dbStructure.Users[user.ID] = user
+		for hash, r := range dbStructure.PasswordResets {
+			if r.UserID == user.ID {
+				delete(dbStructure.PasswordResets, hash)
+			}
+		}
+		dbStructure.revokeUserRefreshTokens(user.ID)
+		return nil
+	})
 	if err != nil {
-		return false, err
+		return User{}, err
 	}
 
-	return true, nil
+	return user, nil
 }
 
-func (db *DB) RevokeRefreshToken(refreshToken string) error {
+func (db *DB) GetUser(id int) (User, error) {
 	dbStructure, err := db.loadDB()
 	if err != nil {
-		return err
+		return User{}, err
 	}
-	dbStructure.RevokedRefreshTokens[refreshToken] = time.Now().UTC()
-	err = db.writeDB(dbStructure)
+
+	user, ok := dbStructure.Users[id]
+	if !ok {
+		return User{}, fmt.Errorf("user does not exists: %v", id)
+	}
+	return user, nil
+}
+
+func (db *DB) FindUserByHandle(handle string) (User, error) {
+	dbStructure, err := db.loadDB()
 	if err != nil {
-		return err
+		return User{}, err
 	}
-	return nil
+
+	id, ok := dbStructure.HandleIDUserMap[strings.ToLower(handle)]
+	if !ok {
+		return User{}, errors.New("user does not exists")
+	}
+	user := dbStructure.Users[id]
+	return user, nil
 }
 
-func (db *DB) CheckRefreshToken(refreshToken string) (bool, error) {
+// GetAuthors returns the public summary of each existing user in ids, keyed by user id
+func (db *DB) GetAuthors(ids ...int) (map[int]AuthorSummary, error) {
 	dbStructure, err := db.loadDB()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	_, ok := dbStructure.RevokedRefreshTokens[refreshToken]
-	return ok, nil
+
+	authors := make(map[int]AuthorSummary, len(ids))
+	for _, id := range ids {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			continue
+		}
+		authors[id] = AuthorSummary{
+			ID:          user.ID,
+			Handle:      user.Handle,
+			DisplayName: user.DisplayName,
+		}
+	}
+	return authors, nil
 }
 
 func (db *DB) FindUserByEmail(email string) (User, error) {
@@ -171,20 +518,61 @@ func (db *DB) FindUserByEmail(email string) (User, error) {
 }
 
 // CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+// Attached media must have been uploaded by the author, and
+// the author can't mention users who blocked them
+func (db *DB) CreateChirp(body string, authorId int, mediaIDs []string) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStructure *DBStructure) error {
+		for _, mediaID := range mediaIDs {
+			if media, ok := dbStructure.Media[mediaID]; !ok || media.OwnerID != authorId {
+				return ErrInvalidMedia
+			}
+		}
+		err := dbStructure.checkMentions(authorId, body)
+		if err != nil {
+			return err
+		}
+
+		dbStructure.LastChirpID++
+		id := dbStructure.LastChirpID
+		chirp = Chirp{
+			ID:       id,
+			Body:     body,
+			AuthorId: authorId,
+			MediaIDs: mediaIDs,
+		}
+		dbStructure.Chirps[id] = chirp
+		return dbStructure.enqueueEvent(EventChirpCreated, authorId, chirp)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	id := len(dbStructure.Chirps) + 1
-	chirp := Chirp{
-		ID:       id,
-		Body:     body,
-		AuthorId: authorId,
-	}
-	dbStructure.Chirps[id] = chirp
-	err = db.writeDB(dbStructure)
+	return chirp, nil
+}
+
+// EditChirp replaces the body of one of the author's chirps
+func (db *DB) EditChirp(ID int, authorId int, body string) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[ID]
+		if !ok || chirp.DeletedAt != nil {
+			return fmt.Errorf("%w: chirp %v", ErrNotFound, ID)
+		}
+		if chirp.AuthorId != authorId {
+			return fmt.Errorf("%w: chirp %v belongs to another user", ErrForbidden, ID)
+		}
+		err := dbStructure.checkMentions(authorId, body)
+		if err != nil {
+			return err
+		}
+		editedAt := time.Now().UTC()
+		chirp.Body = body
+		chirp.EditedAt = &editedAt
+		dbStructure.Chirps[ID] = chirp
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -192,7 +580,22 @@ func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
 	return chirp, nil
 }
 
-func (db *DB) GetChirps(authorIds ...int) ([]Chirp, error) {
+// checkMentions returns ErrBlocked when body mentions a user who blocked the author
+func (dbStructure DBStructure) checkMentions(authorId int, body string) error {
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		if mentionedID, ok := dbStructure.HandleIDUserMap[strings.ToLower(match[1])]; ok {
+			err := dbStructure.checkInteraction(authorId, mentionedID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetChirps returns every chirp, or only an author's chirps, that the viewer
+// hasn't muted and isn't blocked from. Anonymous viewers have id 0
+func (db *DB) GetChirps(viewerID int, authorIds ...int) ([]Chirp, error) {
 	authorId := 0
 	if len(authorIds) > 0 {
 		authorId = authorIds[0]
@@ -204,6 +607,9 @@ func (db *DB) GetChirps(authorIds ...int) ([]Chirp, error) {
 
 	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
 	for _, chirp := range dbStructure.Chirps {
+		if chirp.DeletedAt != nil || !dbStructure.visibleTo(chirp, viewerID) {
+			continue
+		}
 		if authorId == 0 {
 			chirps = append(chirps, chirp)
 		} else if authorId == chirp.AuthorId {
@@ -215,41 +621,110 @@ func (db *DB) GetChirps(authorIds ...int) ([]Chirp, error) {
 	return chirps, nil
 }
 
-func (db *DB) GetChirp(ID int) (Chirp, error) {
+// GetChirp hides chirps across a block from the viewer, but not chirps they've muted
+func (db *DB) GetChirp(ID int, viewerID int) (Chirp, error) {
 	dbStructure, err := db.loadDB()
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	if chirp, ok := dbStructure.Chirps[ID]; ok {
-		fmt.Printf("Chirp %v found, author id: %v\n", ID, chirp.AuthorId)
-		return chirp, nil
+	chirp, ok := dbStructure.Chirps[ID]
+	if !ok || chirp.DeletedAt != nil || dbStructure.blockedBetween(viewerID, chirp.AuthorId) {
+		return Chirp{}, fmt.Errorf("%w: chirp %v", ErrNotFound, ID)
 	}
-
-	return Chirp{}, errors.New(fmt.Sprintf("unable to find chirp id %v", ID))
+	return chirp, nil
 }
 
-func (db *DB) DeleteChirp(ID int, UserId int) (bool, error) {
+// GetUserChirps returns every chirp the user wrote, including deleted chirps
+// that can still be restored, regardless of blocks and mutes
+func (db *DB) GetUserChirps(userID int) ([]Chirp, error) {
 	dbStructure, err := db.loadDB()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	chirp, ok := dbStructure.Chirps[ID]
-	if !ok {
-		return false, errors.New(fmt.Sprintf("unable to find chirp id %v", ID))
-	}
-	if chirp.AuthorId != UserId {
-		return false, errors.New(fmt.Sprintf("unauthorized to perform task", ID))
+	chirps := []Chirp{}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId == userID {
+			chirps = append(chirps, chirp)
+		}
 	}
-	delete(dbStructure.Chirps, ID)
+	return chirps, nil
+}
+
+// DeleteChirp lets authors delete their own chirps and moderators delete any chirp.
+// Deleted chirps are hidden and can be restored until PurgeDeletedChirps removes them.
+// Moderators deleting someone else's chirp is recorded in the audit log. The
+// role is read here rather than from the caller's token, so a demoted
+// moderator can't keep using it
+func (db *DB) DeleteChirp(ID int, UserId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[ID]
+		if !ok || chirp.DeletedAt != nil {
+			return fmt.Errorf("%w: chirp %v", ErrNotFound, ID)
+		}
+		if chirp.AuthorId != UserId && !dbStructure.actorHasRole(UserId, RoleModerator) {
+			return fmt.Errorf("%w: chirp %v belongs to another user", ErrForbidden, ID)
+		}
+		deletedAt := time.Now().UTC()
+		chirp.DeletedAt = &deletedAt
+		dbStructure.Chirps[ID] = chirp
+		if chirp.AuthorId != UserId {
+			dbStructure.appendAudit(UserId, "chirp.deleted", chirp.AuthorId, fmt.Sprintf("chirp %v", ID))
+		}
+		return dbStructure.enqueueEvent(EventChirpDeleted, chirp.AuthorId, struct {
+			ID        int `json:"id"`
+			AuthorID  int `json:"author_id"`
+			DeletedBy int `json:"deleted_by"`
+		}{
+			ID:        ID,
+			AuthorID:  chirp.AuthorId,
+			DeletedBy: UserId,
+		})
+	})
+}
 
-	err = db.writeDB(dbStructure)
+// RestoreChirp undoes DeleteChirp if it happened less than undoWindow ago
+func (db *DB) RestoreChirp(ID int, UserId int, undoWindow time.Duration) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[ID]
+		if !ok || chirp.DeletedAt == nil || time.Since(*chirp.DeletedAt) > undoWindow {
+			return fmt.Errorf("%w: deleted chirp %v", ErrNotFound, ID)
+		}
+		if chirp.AuthorId != UserId && !dbStructure.actorHasRole(UserId, RoleModerator) {
+			return fmt.Errorf("%w: chirp %v belongs to another user", ErrForbidden, ID)
+		}
+		chirp.DeletedAt = nil
+		dbStructure.Chirps[ID] = chirp
+		if chirp.AuthorId != UserId {
+			dbStructure.appendAudit(UserId, "chirp.restored", chirp.AuthorId, fmt.Sprintf("chirp %v", ID))
+		}
+		return nil
+	})
 	if err != nil {
-		return false, err
+		return Chirp{}, err
 	}
 
-	return true, nil
+	return chirp, nil
+}
+
+// PurgeDeletedChirps permanently removes chirps deleted more than undoWindow ago
+func (db *DB) PurgeDeletedChirps(undoWindow time.Duration) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		purged := 0
+		for id, chirp := range dbStructure.Chirps {
+			if chirp.DeletedAt != nil && time.Since(*chirp.DeletedAt) > undoWindow {
+				delete(dbStructure.Chirps, id)
+				purged++
+			}
+		}
+		if purged == 0 {
+			return errNoChange
+		}
+		return nil
+	})
 }
 
 // ensureDB creates a new database file if it doesn't exist
@@ -275,7 +750,57 @@ func DeleteDB(fileName string) {
 func (db *DB) loadDB() (DBStructure, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
+	return db.readFile()
+}
 
+// update loads the database, applies change and writes the result, holding the
+// write lock throughout so concurrent updates can't overwrite each other.
+// Nothing is written when change returns an error, and errNoChange is
+// returned as nil
+func (db *DB) update(change func(dbStructure *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.readFile()
+	if err != nil {
+		return err
+	}
+	err = change(&dbStructure)
+	if errors.Is(err, errNoChange) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.writeFile(dbStructure)
+}
+
+// cached returns the snapshot of the database, reading the file only when
+// there isn't one yet. Callers must not change what it returns
+func (db *DB) cached() (*DBStructure, error) {
+	db.mux.RLock()
+	snapshot := db.snapshot
+	db.mux.RUnlock()
+	if snapshot != nil {
+		return snapshot, nil
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if db.snapshot == nil {
+		dbStructure, err := db.readFile()
+		if err != nil {
+			return nil, err
+		}
+		db.snapshot = &dbStructure
+	}
+	return db.snapshot, nil
+}
+
+// errNoChange tells update there is nothing to write
+var errNoChange = errors.New("no change")
+
+func (db *DB) readFile() (DBStructure, error) {
 	dbStructure := DBStructure{}
 	dat, err := os.ReadFile(db.path)
 	if errors.Is(err, os.ErrNotExist) {
@@ -285,21 +810,85 @@ func (db *DB) loadDB() (DBStructure, error) {
 	if err != nil {
 		return dbStructure, err
 	}
+	dbStructure.backfill()
 	return dbStructure, nil
 }
 
+// backfill creates the collections missing from database files written before they were added
+func (dbStructure *DBStructure) backfill() {
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = map[string]RefreshToken{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[string]Session{}
+	}
+	if dbStructure.Webhooks == nil {
+		dbStructure.Webhooks = map[string]Webhook{}
+	}
+	if dbStructure.WebhookDeliveries == nil {
+		dbStructure.WebhookDeliveries = map[string]WebhookDelivery{}
+	}
+	if dbStructure.PolkaEvents == nil {
+		dbStructure.PolkaEvents = map[string]PolkaEvent{}
+	}
+	if dbStructure.HandleIDUserMap == nil {
+		dbStructure.HandleIDUserMap = map[string]int{}
+	}
+	if dbStructure.PasswordResets == nil {
+		dbStructure.PasswordResets = map[string]PasswordReset{}
+	}
+	if dbStructure.Media == nil {
+		dbStructure.Media = map[string]Media{}
+	}
+	if dbStructure.Blocks == nil {
+		dbStructure.Blocks = relations{}
+	}
+	if dbStructure.Mutes == nil {
+		dbStructure.Mutes = relations{}
+	}
+	for id, user := range dbStructure.Users {
+		if user.LegacyChirpyRed && user.Subscription.Status == "" {
+			user.Subscription = Subscription{
+				Plan:   PlanChirpyRed,
+				Status: SubscriptionActive,
+			}
+			user.LegacyChirpyRed = false
+			dbStructure.Users[id] = user
+		}
+	}
+	// ids used to be derived from the number of records
+	if dbStructure.LastUserID == 0 {
+		for id := range dbStructure.Users {
+			dbStructure.LastUserID = max(dbStructure.LastUserID, id)
+		}
+	}
+	if dbStructure.LastChirpID == 0 {
+		for id := range dbStructure.Chirps {
+			dbStructure.LastChirpID = max(dbStructure.LastChirpID, id)
+		}
+	}
+}
+
 // writeDB writes the database file to disk
 func (db *DB) writeDB(dbStructure DBStructure) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
+	return db.writeFile(dbStructure)
+}
 
+// writeFile saves dbStructure and makes it the snapshot. The caller must hold
+// the write lock and not change dbStructure afterwards
+func (db *DB) writeFile(dbStructure DBStructure) error {
 	dat, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
 	err = os.WriteFile(db.path, dat, 0600)
 	if err != nil {
+		// the file may or may not have been written, the next cached call reads it again
+		db.snapshot = nil
 		return err
 	}
+	db.snapshot = &dbStructure
 	return nil
 }
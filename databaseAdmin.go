@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const RoleUser = "user"
+const RoleModerator = "moderator"
+const RoleAdmin = "admin"
+
+// roleRanks orders roles so each one has the privileges of those below it
+var roleRanks = map[string]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+var ErrInvalidRole = errors.New("role must be user, moderator or admin")
+
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	ActorID   int       `json:"actor_id"`
+	Action    string    `json:"action"`
+	TargetID  int       `json:"target_id"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RoleOrDefault treats users created before roles existed as regular users
+func (u User) RoleOrDefault() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+// hasRole reports whether role grants at least the privileges of required
+func hasRole(role, required string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[required]
+}
+
+// actorHasRole reports whether the user acting currently holds at least role.
+// An actorID of 0 is the server itself, which holds every role
+func (dbStructure DBStructure) actorHasRole(actorID int, role string) bool {
+	if actorID == 0 {
+		return true
+	}
+	user, ok := dbStructure.Users[actorID]
+	return ok && hasRole(user.Role, role)
+}
+
+// SetRole changes a user's role and records the change in the audit log.
+// An actorID of 0 means the change was made by the server itself
+func (db *DB) SetRole(actorID int, userID int, role string) (User, error) {
+	if _, ok := roleRanks[role]; !ok {
+		return User{}, ErrInvalidRole
+	}
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		oldRole := user.RoleOrDefault()
+		if oldRole == role {
+			return errNoChange
+		}
+		user.Role = role
+		dbStructure.Users[userID] = user
+		dbStructure.appendAudit(actorID, "role.changed", userID, oldRole+" -> "+role)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// RecordAudit adds an entry to the audit log on its own
+func (db *DB) RecordAudit(actorID int, action string, targetID int, detail string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.appendAudit(actorID, action, targetID, detail)
+		return nil
+	})
+}
+
+func (db *DB) GetAuditLog() ([]AuditEntry, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return dbStructure.AuditLog, nil
+}
+
+func (db *DB) GetUsers() ([]User, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(dbStructure.Users))
+	for _, user := range dbStructure.Users {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (dbStructure *DBStructure) appendAudit(actorID int, action string, targetID int, detail string) {
+	dbStructure.AuditLog = append(dbStructure.AuditLog, AuditEntry{
+		ID:        len(dbStructure.AuditLog) + 1,
+		ActorID:   actorID,
+		Action:    action,
+		TargetID:  targetID,
+		Detail:    detail,
+		CreatedAt: time.Now().UTC(),
+	})
+}
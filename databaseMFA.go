@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrMFAEnabled = errors.New("two-factor authentication is already enabled")
+var ErrMFANotEnabled = errors.New("two-factor authentication is not enabled")
+var ErrInvalidMFACode = errors.New("invalid two-factor code")
+var ErrInvalidMFAChallenge = errors.New("mfa_token is invalid or was already used")
+var ErrMFALocked = errors.New("too many invalid two-factor codes, try again later")
+
+// maxMFAFailures invalid codes in a row lock the second factor for mfaLockout
+const maxMFAFailures = 5
+const mfaLockout = 15 * time.Minute
+
+// TOTPEnrollment holds a user's authenticator secret and recovery codes
+type TOTPEnrollment struct {
+	// Secret is set once the user has confirmed their authenticator
+	Secret string `json:"secret,omitempty"`
+	// PendingSecret waits for the first code from a new authenticator
+	PendingSecret string `json:"pending_secret,omitempty"`
+	// LastStep is the last time step a code was accepted for, so codes can't be replayed
+	LastStep int64 `json:"last_step,omitempty"`
+	// RecoveryCodes are the hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// ChallengeHash is the hash of the jti of the last mfa_token issued at login,
+	// cleared once it is used so it completes a single login
+	ChallengeHash string `json:"challenge_hash,omitempty"`
+	// FailedAttempts counts the invalid codes since the last valid one
+	FailedAttempts int        `json:"failed_attempts,omitempty"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+}
+
+func (t TOTPEnrollment) Enabled() bool {
+	return t.Secret != ""
+}
+
+func (t TOTPEnrollment) locked(now time.Time) bool {
+	return t.LockedUntil != nil && now.Before(*t.LockedUntil)
+}
+
+// UseStep records that a code for step was accepted, refusing steps that
+// are not newer than the last one used
+func (t *TOTPEnrollment) UseStep(step int64) error {
+	if step <= t.LastStep {
+		return ErrInvalidMFACode
+	}
+	t.LastStep = step
+	return nil
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash
+func (t *TOTPEnrollment) UseRecoveryCode(codeHash string) error {
+	for i, hash := range t.RecoveryCodes {
+		if hash == codeHash {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInvalidMFACode
+}
+
+// BeginTOTP stores a new secret until the user confirms it with a code
+func (db *DB) BeginTOTP(userID int, secret string) error {
+	return db.updateTOTP(userID, func(totp *TOTPEnrollment) error {
+		if totp.Enabled() {
+			return ErrMFAEnabled
+		}
+		totp.PendingSecret = secret
+		return nil
+	})
+}
+
+// ConfirmTOTP enables the pending secret once a code for step was accepted for it
+func (db *DB) ConfirmTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	return db.updateTOTP(userID, func(totp *TOTPEnrollment) error {
+		if totp.Enabled() {
+			return ErrMFAEnabled
+		}
+		if totp.PendingSecret == "" {
+			return ErrMFANotEnabled
+		}
+		*totp = TOTPEnrollment{
+			Secret:        totp.PendingSecret,
+			LastStep:      step,
+			RecoveryCodes: recoveryCodeHashes,
+		}
+		return nil
+	})
+}
+
+// StartMFAChallenge stores the hash of the jti of a new mfa_token, replacing
+// any issued before
+func (db *DB) StartMFAChallenge(userID int, challengeHash string) error {
+	return db.updateTOTP(userID, func(totp *TOTPEnrollment) error {
+		if !totp.Enabled() {
+			return ErrMFANotEnabled
+		}
+		if totp.locked(time.Now().UTC()) {
+			return ErrMFALocked
+		}
+		totp.ChallengeHash = challengeHash
+		return nil
+	})
+}
+
+// UseSecondFactor calls check to validate a code against the user's enrollment
+// and use it up. A non-empty challengeHash must be the pending login challenge,
+// which is consumed when the code is valid. Invalid codes are counted, and
+// after maxMFAFailures the second factor is locked for mfaLockout and the
+// pending challenge dropped, so logging in starts over with the password
+func (db *DB) UseSecondFactor(userID int, challengeHash string, check func(totp *TOTPEnrollment) error) error {
+	var invalid error
+	err := db.updateTOTP(userID, func(totp *TOTPEnrollment) error {
+		if !totp.Enabled() {
+			return ErrMFANotEnabled
+		}
+		now := time.Now().UTC()
+		if totp.locked(now) {
+			return ErrMFALocked
+		}
+		if challengeHash != "" && challengeHash != totp.ChallengeHash {
+			return ErrInvalidMFAChallenge
+		}
+		err := check(totp)
+		if errors.Is(err, ErrInvalidMFACode) {
+			// the failure is saved, so the update mustn't fail
+			invalid = err
+			totp.FailedAttempts++
+			if totp.FailedAttempts >= maxMFAFailures {
+				lockedUntil := now.Add(mfaLockout)
+				totp.LockedUntil = &lockedUntil
+				totp.FailedAttempts = 0
+				totp.ChallengeHash = ""
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		totp.FailedAttempts = 0
+		totp.LockedUntil = nil
+		if challengeHash != "" {
+			totp.ChallengeHash = ""
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return invalid
+}
+
+// DisableTOTP removes the user's authenticator and recovery codes
+func (db *DB) DisableTOTP(userID int) error {
+	return db.updateTOTP(userID, func(totp *TOTPEnrollment) error {
+		if !totp.Enabled() {
+			return ErrMFANotEnabled
+		}
+		*totp = TOTPEnrollment{}
+		return nil
+	})
+}
+
+func (db *DB) updateTOTP(userID int, update func(totp *TOTPEnrollment) error) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("user does not exists: %v", userID)
+		}
+		err := update(&user.TOTP)
+		if err != nil {
+			return err
+		}
+		dbStructure.Users[userID] = user
+		return nil
+	})
+}
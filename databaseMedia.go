@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type Media struct {
+	ID           string    `json:"id"`
+	OwnerID      int       `json:"owner_id"`
+	ContentType  string    `json:"content_type"`
+	Size         int       `json:"size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Key          string    `json:"key"`
+	ThumbnailKey string    `json:"thumbnail_key"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CreateMedia records an upload whose blobs are already stored
+func (db *DB) CreateMedia(media Media) (Media, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Media[media.ID]; ok {
+			return fmt.Errorf("media already exists: %v", media.ID)
+		}
+		dbStructure.Media[media.ID] = media
+		return nil
+	})
+	if err != nil {
+		return Media{}, err
+	}
+
+	return media, nil
+}
+
+func (db *DB) GetMedia(id string) (Media, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Media{}, err
+	}
+
+	media, ok := dbStructure.Media[id]
+	if !ok {
+		return Media{}, ErrInvalidMedia
+	}
+	return media, nil
+}
+
+// GetUserMedia returns the user's uploads, oldest first
+func (db *DB) GetUserMedia(ownerID int) ([]Media, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	media := []Media{}
+	for _, m := range dbStructure.Media {
+		if m.OwnerID == ownerID {
+			media = append(media, m)
+		}
+	}
+	sort.Slice(media, func(i, j int) bool {
+		return media[i].CreatedAt.Before(media[j].CreatedAt)
+	})
+	return media, nil
+}
+
+// setAvatar uses one of the user's uploads as their avatar, or clears it when mediaID is empty
+func (dbStructure DBStructure) setAvatar(userID int, mediaID string) (User, error) {
+	user, ok := dbStructure.Users[userID]
+	if !ok {
+		return User{}, fmt.Errorf("user does not exists: %v", userID)
+	}
+	user.Avatar = ""
+	if mediaID != "" {
+		media, ok := dbStructure.Media[mediaID]
+		if !ok || media.OwnerID != userID {
+			return User{}, ErrInvalidMedia
+		}
+		user.Avatar = media.ThumbnailKey
+	}
+	dbStructure.Users[userID] = user
+	return user, nil
+}
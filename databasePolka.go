@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Polka event statuses
+const PolkaReceived = "received"
+const PolkaProcessing = "processing"
+const PolkaProcessed = "processed"
+const PolkaIgnored = "ignored"
+const PolkaFailed = "failed"
+
+// polkaClaimTimeout is how long an event stays claimed by a caller that never
+// finished it, after which another may process it
+const polkaClaimTimeout = time.Minute
+
+var ErrPolkaEventClaimed = errors.New("event is being processed")
+var ErrPolkaEventDone = errors.New("event was already processed")
+
+// PolkaEvent is a webhook received from Polka, kept so retried deliveries of
+// the same event aren't processed twice and failed ones can be replayed
+type PolkaEvent struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Deliveries  int             `json:"deliveries"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ProcessedAt *time.Time      `json:"processed_at,omitempty"`
+	// ClaimedBy identifies the caller processing the event while it's processing
+	ClaimedBy string     `json:"claimed_by,omitempty"`
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+}
+
+// Done reports whether the event needs no more processing
+func (event PolkaEvent) Done() bool {
+	return event.Status == PolkaProcessed || event.Status == PolkaIgnored
+}
+
+// claim marks the event processing by owner, unless it's done or another
+// caller claimed it less than polkaClaimTimeout ago
+func (event *PolkaEvent) claim(owner string, now time.Time) error {
+	if event.Done() {
+		return ErrPolkaEventDone
+	}
+	if event.Status == PolkaProcessing && event.ClaimedAt != nil && now.Sub(*event.ClaimedAt) < polkaClaimTimeout {
+		return ErrPolkaEventClaimed
+	}
+	event.Status = PolkaProcessing
+	event.ClaimedBy = owner
+	event.ClaimedAt = &now
+	return nil
+}
+
+// RecordPolkaEvent stores an event the first time it is delivered, counts later
+// deliveries and claims it for owner to process, returning the event as stored.
+// It returns ErrPolkaEventDone with the event when it needs no more processing,
+// and ErrPolkaEventClaimed when another delivery is processing it
+func (db *DB) RecordPolkaEvent(event PolkaEvent, owner string) (PolkaEvent, error) {
+	var stored PolkaEvent
+	var claimErr error
+	err := db.update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		var ok bool
+		stored, ok = dbStructure.PolkaEvents[event.ID]
+		if !ok {
+			stored = event
+			stored.Status = PolkaReceived
+			stored.ReceivedAt = now
+		}
+		stored.Deliveries++
+		// the delivery is counted even when it can't be claimed
+		claimErr = stored.claim(owner, now)
+		dbStructure.PolkaEvents[event.ID] = stored
+		return nil
+	})
+	if err != nil {
+		return PolkaEvent{}, err
+	}
+
+	return stored, claimErr
+}
+
+// ClaimPolkaEvent claims a recorded event for owner to process again
+func (db *DB) ClaimPolkaEvent(id string, owner string) (PolkaEvent, error) {
+	var event PolkaEvent
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		event, ok = dbStructure.PolkaEvents[id]
+		if !ok {
+			return ErrNotFound
+		}
+		err := event.claim(owner, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		dbStructure.PolkaEvents[id] = event
+		return nil
+	})
+	if err != nil {
+		return event, err
+	}
+
+	return event, nil
+}
+
+// FinishPolkaEvent records the outcome of processing an event owner claimed,
+// and returns ErrPolkaEventClaimed if the claim was lost to another caller
+func (db *DB) FinishPolkaEvent(id string, owner string, status string, processErr error) (PolkaEvent, error) {
+	var event PolkaEvent
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		event, ok = dbStructure.PolkaEvents[id]
+		if !ok {
+			return ErrNotFound
+		}
+		if event.Status != PolkaProcessing || event.ClaimedBy != owner {
+			return ErrPolkaEventClaimed
+		}
+		now := time.Now().UTC()
+		event.Status = status
+		event.Attempts++
+		event.LastError = ""
+		if processErr != nil {
+			event.LastError = processErr.Error()
+		}
+		if event.Done() {
+			event.ProcessedAt = &now
+		}
+		event.ClaimedBy = ""
+		event.ClaimedAt = nil
+		dbStructure.PolkaEvents[id] = event
+		return nil
+	})
+	if err != nil {
+		return PolkaEvent{}, err
+	}
+
+	return event, nil
+}
+
+func (db *DB) GetPolkaEvent(id string) (PolkaEvent, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return PolkaEvent{}, err
+	}
+	event, ok := dbStructure.PolkaEvents[id]
+	if !ok {
+		return PolkaEvent{}, ErrNotFound
+	}
+	return event, nil
+}
+
+// GetPolkaEvents returns every event, or only those with status when it isn't empty
+func (db *DB) GetPolkaEvents(status string) ([]PolkaEvent, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []PolkaEvent{}
+	for _, event := range dbStructure.PolkaEvents {
+		if status == "" || event.Status == status {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRecordPolkaEventClaimsOnce(t *testing.T) {
+	db := newTestDB(t)
+	event := PolkaEvent{ID: "evt_1", Type: USER_UPGRADED, Payload: []byte(`{}`)}
+
+	const deliveries = 10
+	var wg sync.WaitGroup
+	owners := make(chan string, deliveries)
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			owner := fmt.Sprintf("delivery-%d", i)
+			_, err := db.RecordPolkaEvent(event, owner)
+			if err == nil {
+				owners <- owner
+			} else if !errors.Is(err, ErrPolkaEventClaimed) {
+				t.Errorf("RecordPolkaEvent: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(owners)
+	claimed := []string{}
+	for owner := range owners {
+		claimed = append(claimed, owner)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("%d deliveries claimed the event, want 1", len(claimed))
+	}
+
+	if _, err := db.FinishPolkaEvent(event.ID, "someone-else", PolkaProcessed, nil); !errors.Is(err, ErrPolkaEventClaimed) {
+		t.Errorf("FinishPolkaEvent by another caller: got %v, want %v", err, ErrPolkaEventClaimed)
+	}
+	finished, err := db.FinishPolkaEvent(event.ID, claimed[0], PolkaProcessed, nil)
+	if err != nil {
+		t.Fatalf("FinishPolkaEvent: %v", err)
+	}
+	if finished.Deliveries != deliveries || finished.Attempts != 1 || finished.ClaimedBy != "" {
+		t.Errorf("event = %+v, want %d deliveries, 1 attempt and no claim", finished, deliveries)
+	}
+
+	if _, err := db.RecordPolkaEvent(event, "late-delivery"); !errors.Is(err, ErrPolkaEventDone) {
+		t.Errorf("RecordPolkaEvent once processed: got %v, want %v", err, ErrPolkaEventDone)
+	}
+	if _, err := db.ClaimPolkaEvent(event.ID, "admin"); !errors.Is(err, ErrPolkaEventDone) {
+		t.Errorf("ClaimPolkaEvent once processed: got %v, want %v", err, ErrPolkaEventDone)
+	}
+}
+
+func TestClaimPolkaEventAfterClaimTimesOut(t *testing.T) {
+	db := newTestDB(t)
+	event := PolkaEvent{ID: "evt_1", Type: USER_UPGRADED, Payload: []byte(`{}`)}
+	if _, err := db.RecordPolkaEvent(event, "crashed"); err != nil {
+		t.Fatalf("RecordPolkaEvent: %v", err)
+	}
+	if _, err := db.ClaimPolkaEvent(event.ID, "admin"); !errors.Is(err, ErrPolkaEventClaimed) {
+		t.Fatalf("ClaimPolkaEvent while claimed: got %v, want %v", err, ErrPolkaEventClaimed)
+	}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		stored := dbStructure.PolkaEvents[event.ID]
+		claimedAt := stored.ClaimedAt.Add(-polkaClaimTimeout)
+		stored.ClaimedAt = &claimedAt
+		dbStructure.PolkaEvents[event.ID] = stored
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := db.ClaimPolkaEvent(event.ID, "admin"); err != nil {
+		t.Fatalf("ClaimPolkaEvent after the claim timed out: %v", err)
+	}
+	if _, err := db.FinishPolkaEvent(event.ID, "crashed", PolkaProcessed, nil); !errors.Is(err, ErrPolkaEventClaimed) {
+		t.Errorf("FinishPolkaEvent by the timed out caller: got %v, want %v", err, ErrPolkaEventClaimed)
+	}
+	stored, err := db.FinishPolkaEvent(event.ID, "admin", PolkaFailed, errors.New("user not found"))
+	if err != nil {
+		t.Fatalf("FinishPolkaEvent: %v", err)
+	}
+	if stored.Status != PolkaFailed || stored.ClaimedAt != nil || stored.ProcessedAt != nil {
+		t.Errorf("event = %+v, want it failed and unclaimed", stored)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+var ErrRefreshTokenReused = errors.New("refresh token was already used, its session has been revoked")
+var ErrSessionEnded = errors.New("session has ended")
+
+// Session is a login on one device. Its ID is also the family ID of the refresh
+// tokens issued to that device
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// RefreshToken is stored under the hash of the opaque token handed to the client.
+// Every token issued by refreshing belongs to the family started at login
+type RefreshToken struct {
+	UserID    int       `json:"user_id"`
+	FamilyID  string    `json:"family_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// RotatedAt is set once the token has been exchanged for a new one
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+}
+
+// CreateSession starts a session and stores the hash of its first refresh token
+func (db *DB) CreateSession(session Session, tokenHash string, expiresAt time.Time) (Session, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[session.UserID]; !ok {
+			return ErrUserNotFound
+		}
+		dbStructure.pruneRefreshTokens()
+		now := time.Now().UTC()
+		session.CreatedAt = now
+		session.LastUsedAt = now
+		dbStructure.Sessions[session.ID] = session
+		dbStructure.RefreshTokens[tokenHash] = RefreshToken{
+			UserID:    session.UserID,
+			FamilyID:  session.ID,
+			CreatedAt: now,
+			ExpiresAt: expiresAt,
+		}
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for newHash in the same family.
+// Presenting a token that was already rotated revokes its whole family, since
+// either the client or whoever stole the token is replaying it. The session is
+// marked as last used from ip
+func (db *DB) RotateRefreshToken(tokenHash, newHash, ip string, expiresAt time.Time) (RefreshToken, error) {
+	var next RefreshToken
+	reused := false
+	err := db.update(func(dbStructure *DBStructure) error {
+		token, ok := dbStructure.RefreshTokens[tokenHash]
+		now := time.Now().UTC()
+		if !ok || now.After(token.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+		if token.RotatedAt != nil {
+			// the revocation is written before the reuse is reported
+			dbStructure.revokeRefreshFamily(token.FamilyID)
+			reused = true
+			return nil
+		}
+
+		token.RotatedAt = &now
+		dbStructure.RefreshTokens[tokenHash] = token
+		if session, ok := dbStructure.Sessions[token.FamilyID]; ok {
+			session.IP = ip
+			session.LastUsedAt = now
+			dbStructure.Sessions[session.ID] = session
+		}
+		next = RefreshToken{
+			UserID:    token.UserID,
+			FamilyID:  token.FamilyID,
+			CreatedAt: now,
+			ExpiresAt: expiresAt,
+		}
+		dbStructure.RefreshTokens[newHash] = next
+		return nil
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+	return next, nil
+}
+
+// RevokeRefreshToken revokes the family a refresh token belongs to
+func (db *DB) RevokeRefreshToken(tokenHash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		token, ok := dbStructure.RefreshTokens[tokenHash]
+		if !ok {
+			return ErrInvalidRefreshToken
+		}
+		dbStructure.revokeRefreshFamily(token.FamilyID)
+		return nil
+	})
+}
+
+// GetSessions returns the user's sessions, most recently used first
+func (db *DB) GetSessions(userID int) ([]Session, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for _, session := range dbStructure.Sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions along with its refresh tokens
+func (db *DB) RevokeSession(userID int, sessionID string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		session, ok := dbStructure.Sessions[sessionID]
+		if !ok || session.UserID != userID {
+			return ErrNotFound
+		}
+		dbStructure.revokeRefreshFamily(sessionID)
+		return nil
+	})
+}
+
+// CheckSession returns ErrSessionEnded unless the user's session is still
+// active. It's called on every authenticated request, so it reads the snapshot
+func (db *DB) CheckSession(userID int, sessionID string) error {
+	dbStructure, err := db.cached()
+	if err != nil {
+		return err
+	}
+	session, ok := dbStructure.Sessions[sessionID]
+	if !ok || session.UserID != userID {
+		return ErrSessionEnded
+	}
+	return nil
+}
+
+// RevokeSessions ends every session of the user
+func (db *DB) RevokeSessions(userID int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.revokeUserRefreshTokens(userID)
+		return nil
+	})
+}
+
+func (dbStructure DBStructure) revokeRefreshFamily(familyID string) {
+	delete(dbStructure.Sessions, familyID)
+	for hash, token := range dbStructure.RefreshTokens {
+		if token.FamilyID == familyID {
+			delete(dbStructure.RefreshTokens, hash)
+		}
+	}
+}
+
+func (dbStructure DBStructure) revokeUserRefreshTokens(userID int) {
+	for id, session := range dbStructure.Sessions {
+		if session.UserID == userID {
+			delete(dbStructure.Sessions, id)
+		}
+	}
+	for hash, token := range dbStructure.RefreshTokens {
+		if token.UserID == userID {
+			delete(dbStructure.RefreshTokens, hash)
+		}
+	}
+}
+
+// pruneRefreshTokens drops expired tokens and the sessions left without any.
+// Rotated tokens are kept until they expire so their reuse can still be detected
+func (dbStructure DBStructure) pruneRefreshTokens() {
+	now := time.Now().UTC()
+	live := map[string]bool{}
+	for hash, token := range dbStructure.RefreshTokens {
+		if now.After(token.ExpiresAt) {
+			delete(dbStructure.RefreshTokens, hash)
+			continue
+		}
+		live[token.FamilyID] = true
+	}
+	for id := range dbStructure.Sessions {
+		if !live[id] {
+			delete(dbStructure.Sessions, id)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestSession(t *testing.T, db *DB, userID int, tokenHash string) Session {
+	t.Helper()
+	session, err := db.CreateSession(Session{ID: "session-" + tokenHash, UserID: userID}, tokenHash, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	return session
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	session := startTestSession(t, db, user.ID, "first")
+
+	next, err := db.RotateRefreshToken("first", "second", "127.0.0.1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+	if next.FamilyID != session.ID || next.UserID != user.ID {
+		t.Errorf("rotated token = %+v, want family %q of user %d", next, session.ID, user.ID)
+	}
+
+	_, err = db.RotateRefreshToken("unknown", "other", "127.0.0.1", time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("unknown token: got %v, want %v", err, ErrInvalidRefreshToken)
+	}
+}
+
+func TestRotateRefreshTokenReuseRevokesFamily(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	startTestSession(t, db, user.ID, "first")
+
+	_, err := db.RotateRefreshToken("first", "second", "127.0.0.1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+	_, err = db.RotateRefreshToken("first", "third", "127.0.0.1", time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reused token: got %v, want %v", err, ErrRefreshTokenReused)
+	}
+	_, err = db.RotateRefreshToken("second", "fourth", "127.0.0.1", time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("token from a revoked family: got %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	sessions, err := db.GetSessions(user.ID)
+	if err != nil {
+		t.Fatalf("GetSessions: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("got %d sessions after reuse, want 0", len(sessions))
+	}
+}
+
+func TestRotateRefreshTokenConcurrently(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	startTestSession(t, db, user.ID, "first")
+
+	const refreshes = 10
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	rotated := 0
+	for i := 0; i < refreshes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.RotateRefreshToken("first", "next-"+string(rune('a'+i)), "127.0.0.1", time.Now().Add(time.Hour))
+			if err == nil {
+				mux.Lock()
+				rotated++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if rotated != 1 {
+		t.Errorf("token was rotated %d times, want once", rotated)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+var ErrBlocked = errors.New("blocked by user")
+
+// relations maps a user id to the ids they've blocked or muted and since when
+type relations map[int]map[int]time.Time
+
+// Relation is a user someone has blocked or muted
+type Relation struct {
+	UserID int       `json:"user_id"`
+	Since  time.Time `json:"since"`
+}
+
+// of returns who userID has blocked or muted, oldest first
+func (r relations) of(userID int) []Relation {
+	related := []Relation{}
+	for targetID, since := range r[userID] {
+		related = append(related, Relation{UserID: targetID, Since: since})
+	}
+	sort.Slice(related, func(i, j int) bool {
+		return related[i].Since.Before(related[j].Since)
+	})
+	return related
+}
+
+func (r relations) has(userID, targetID int) bool {
+	_, ok := r[userID][targetID]
+	return ok
+}
+
+func (db *DB) BlockUser(userID, targetID int) error {
+	return db.setRelation(userID, targetID, true, func(s DBStructure) relations { return s.Blocks })
+}
+
+func (db *DB) UnblockUser(userID, targetID int) error {
+	return db.setRelation(userID, targetID, false, func(s DBStructure) relations { return s.Blocks })
+}
+
+func (db *DB) MuteUser(userID, targetID int) error {
+	return db.setRelation(userID, targetID, true, func(s DBStructure) relations { return s.Mutes })
+}
+
+func (db *DB) UnmuteUser(userID, targetID int) error {
+	return db.setRelation(userID, targetID, false, func(s DBStructure) relations { return s.Mutes })
+}
+
+// GetRelations returns the users userID has blocked and the ones they've muted
+func (db *DB) GetRelations(userID int) (blocks []Relation, mutes []Relation, err error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	return dbStructure.Blocks.of(userID), dbStructure.Mutes.of(userID), nil
+}
+
+func (db *DB) setRelation(userID, targetID int, on bool, kind func(DBStructure) relations) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[targetID]; !ok {
+			return ErrUserNotFound
+		}
+
+		r := kind(*dbStructure)
+		if on {
+			if r[userID] == nil {
+				r[userID] = map[int]time.Time{}
+			}
+			if _, ok := r[userID][targetID]; !ok {
+				r[userID][targetID] = time.Now().UTC()
+			}
+		} else {
+			delete(r[userID], targetID)
+			if len(r[userID]) == 0 {
+				delete(r, userID)
+			}
+		}
+		return nil
+	})
+}
+
+// blockedBetween reports whether either user has blocked the other
+func (dbStructure DBStructure) blockedBetween(userID, otherID int) bool {
+	return dbStructure.Blocks.has(userID, otherID) || dbStructure.Blocks.has(otherID, userID)
+}
+
+// visibleTo reports whether a chirp belongs in the viewer's listings. Anonymous
+// viewers, with id 0, see everything
+func (dbStructure DBStructure) visibleTo(chirp Chirp, viewerID int) bool {
+	if viewerID == 0 {
+		return true
+	}
+	return !dbStructure.blockedBetween(viewerID, chirp.AuthorId) && !dbStructure.Mutes.has(viewerID, chirp.AuthorId)
+}
+
+// checkInteraction returns ErrBlocked when targetID has blocked userID, so userID
+// can't mention them or interact with their chirps
+func (dbStructure DBStructure) checkInteraction(userID, targetID int) error {
+	if dbStructure.Blocks.has(targetID, userID) {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// removeRelations drops everything the user blocked or muted and every block or mute of them
+func (dbStructure DBStructure) removeRelations(userID int) {
+	for _, r := range []relations{dbStructure.Blocks, dbStructure.Mutes} {
+		delete(r, userID)
+		for id, targets := range r {
+			delete(targets, userID)
+			if len(targets) == 0 {
+				delete(r, id)
+			}
+		}
+	}
+}
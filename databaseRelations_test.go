@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChirpsHiddenByBlocksAndMutes(t *testing.T) {
+	db := newTestDB(t)
+	walt := createTestUser(t, db, "walt@example.com")
+	jesse := createTestUser(t, db, "jesse@example.com")
+	skyler := createTestUser(t, db, "skyler@example.com")
+	chirps := map[int]Chirp{}
+	for _, user := range []User{walt, jesse, skyler} {
+		chirp, err := db.CreateChirp("say my name", user.ID, nil)
+		if err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+		chirps[user.ID] = chirp
+	}
+	if err := db.MuteUser(walt.ID, jesse.ID); err != nil {
+		t.Fatalf("MuteUser: %v", err)
+	}
+	if err := db.BlockUser(skyler.ID, walt.ID); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		viewerID int
+		authorID int
+		listed   bool
+		found    bool
+	}{
+		{name: "own chirp", viewerID: walt.ID, authorID: walt.ID, listed: true, found: true},
+		// muting only takes chirps out of listings
+		{name: "muted author", viewerID: walt.ID, authorID: jesse.ID, listed: false, found: true},
+		{name: "author who blocked the viewer", viewerID: walt.ID, authorID: skyler.ID, listed: false, found: false},
+		{name: "author the viewer blocked", viewerID: skyler.ID, authorID: walt.ID, listed: false, found: false},
+		{name: "muting is one way", viewerID: jesse.ID, authorID: walt.ID, listed: true, found: true},
+		{name: "anonymous viewer", viewerID: 0, authorID: skyler.ID, listed: true, found: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed, err := db.GetChirps(tt.viewerID, tt.authorID)
+			if err != nil {
+				t.Fatalf("GetChirps: %v", err)
+			}
+			if got := len(listed) == 1; got != tt.listed {
+				t.Errorf("GetChirps listed the chirp: %v, want %v", got, tt.listed)
+			}
+			all, err := db.GetChirps(tt.viewerID)
+			if err != nil {
+				t.Fatalf("GetChirps: %v", err)
+			}
+			inAll := false
+			for _, chirp := range all {
+				inAll = inAll || chirp.AuthorId == tt.authorID
+			}
+			if inAll != tt.listed {
+				t.Errorf("GetChirps for every author listed the chirp: %v, want %v", inAll, tt.listed)
+			}
+
+			_, err = db.GetChirp(chirps[tt.authorID].ID, tt.viewerID)
+			if tt.found && err != nil {
+				t.Errorf("GetChirp: %v", err)
+			}
+			if !tt.found && !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetChirp: got %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestMentionsOfUsersWhoBlockedTheAuthor(t *testing.T) {
+	db := newTestDB(t)
+	walt := createTestUser(t, db, "walt@example.com")
+	jesse := createTestUser(t, db, "jesse@example.com")
+	skyler := createTestUser(t, db, "skyler@example.com")
+	handle := "Skyler"
+	if _, err := db.ChangeUser(skyler.ID, UserChanges{Handle: &handle}); err != nil {
+		t.Fatalf("ChangeUser: %v", err)
+	}
+	chirp, err := db.CreateChirp("say my name", walt.ID, nil)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	if err := db.BlockUser(skyler.ID, walt.ID); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+
+	if _, err := db.CreateChirp("hey @skyler", walt.ID, nil); !errors.Is(err, ErrBlocked) {
+		t.Errorf("mentioning a user who blocked the author: got %v, want %v", err, ErrBlocked)
+	}
+	if _, err := db.EditChirp(chirp.ID, walt.ID, "hey @SKYLER"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("editing in a mention of a user who blocked the author: got %v, want %v", err, ErrBlocked)
+	}
+	if _, err := db.CreateChirp("hey @skyler", jesse.ID, nil); err != nil {
+		t.Errorf("mentioning a user who blocked someone else: %v", err)
+	}
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		t.Fatalf("loadDB: %v", err)
+	}
+	if err := dbStructure.checkInteraction(walt.ID, skyler.ID); !errors.Is(err, ErrBlocked) {
+		t.Errorf("checkInteraction with a user who blocked them: got %v, want %v", err, ErrBlocked)
+	}
+	// blocking someone doesn't stop you interacting with them
+	if err := dbStructure.checkInteraction(skyler.ID, walt.ID); err != nil {
+		t.Errorf("checkInteraction with a user they blocked: %v", err)
+	}
+
+	if err := db.UnblockUser(skyler.ID, walt.ID); err != nil {
+		t.Fatalf("UnblockUser: %v", err)
+	}
+	if _, err := db.CreateChirp("hey @skyler", walt.ID, nil); err != nil {
+		t.Errorf("mentioning after the block was lifted: %v", err)
+	}
+}
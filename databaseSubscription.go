@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const PlanFree = "free"
+const PlanChirpyRed = "chirpy_red"
+
+// plans are the paid plans Polka can subscribe users to
+var plans = map[string]bool{
+	PlanChirpyRed: true,
+}
+
+// Subscription statuses
+const SubscriptionActive = "active"
+const SubscriptionPastDue = "past_due"
+const SubscriptionCanceled = "canceled"
+const SubscriptionExpired = "expired"
+
+var ErrNoSubscription = errors.New("user has no subscription")
+var ErrUnknownPlan = errors.New("unknown plan")
+
+// Subscription is a user's paid membership, kept up to date from Polka events
+type Subscription struct {
+	Plan      string     `json:"plan,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// ExpiresAt is the end of the paid period. Memberships Polka started without
+	// one, like those from before subscriptions were tracked, last until they are ended
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// GraceUntil keeps a past due membership going while payment is retried
+	GraceUntil *time.Time `json:"grace_until,omitempty"`
+	CanceledAt *time.Time `json:"canceled_at,omitempty"`
+}
+
+// Active reports whether the membership grants the plan at now. Canceled
+// memberships last until the end of the period that was paid for
+func (s Subscription) Active(now time.Time) bool {
+	switch s.Status {
+	case SubscriptionActive, SubscriptionCanceled:
+		return s.ExpiresAt == nil || now.Before(*s.ExpiresAt)
+	case SubscriptionPastDue:
+		return s.GraceUntil != nil && now.Before(*s.GraceUntil)
+	default:
+		return false
+	}
+}
+
+// IsChirpyRed is derived from the user's subscription
+func (u User) IsChirpyRed() bool {
+	return u.Plan() == PlanChirpyRed
+}
+
+// Plan is the plan the user currently has, PlanFree without an active subscription
+func (u User) Plan() string {
+	if !u.Subscription.Active(time.Now()) {
+		return PlanFree
+	}
+	return u.Subscription.Plan
+}
+
+// subscriptionResponse is the user's subscription, or nil if they never had one.
+// Memberships that lapsed show as expired before the scheduler gets to them
+func subscriptionResponse(user User) *Subscription {
+	s := user.Subscription
+	if s.Status == "" {
+		return nil
+	}
+	if !s.Active(time.Now()) {
+		s.Status = SubscriptionExpired
+	}
+	return &s
+}
+
+// SubscriptionChange is what a Polka event tells us about a subscription.
+// Zero values are filled in with the plan defaults
+type SubscriptionChange struct {
+	Plan      string
+	ExpiresAt *time.Time
+}
+
+// SubscriptionTerms are the server's subscription settings
+type SubscriptionTerms struct {
+	// Period is how long a renewal extends a membership when Polka doesn't say
+	Period time.Duration
+	// Grace is how long a past due membership is kept while payment is retried
+	Grace time.Duration
+}
+
+// StartSubscription starts or reactivates a user's membership, open-ended
+// unless Polka says when it expires
+func (db *DB) StartSubscription(userID int, change SubscriptionChange, terms SubscriptionTerms) (User, error) {
+	return db.updateSubscription(userID, func(s *Subscription, now time.Time) error {
+		plan := change.Plan
+		if plan == "" {
+			plan = PlanChirpyRed
+		}
+		if !plans[plan] {
+			return fmt.Errorf("%w: %s", ErrUnknownPlan, plan)
+		}
+		if !s.Active(now) || s.Plan != plan {
+			s.StartedAt = &now
+		}
+		s.Plan = plan
+		s.Status = SubscriptionActive
+		s.ExpiresAt = nil
+		if change.ExpiresAt != nil {
+			expiresAt := change.ExpiresAt.UTC()
+			s.ExpiresAt = &expiresAt
+		}
+		s.GraceUntil = nil
+		s.CanceledAt = nil
+		return nil
+	})
+}
+
+// RenewSubscription extends a membership by another period. Open-ended
+// memberships stay open-ended unless Polka says when it expires
+func (db *DB) RenewSubscription(userID int, change SubscriptionChange, terms SubscriptionTerms) (User, error) {
+	return db.updateSubscription(userID, func(s *Subscription, now time.Time) error {
+		if s.Status == "" {
+			return ErrNoSubscription
+		}
+		openEnded := s.ExpiresAt == nil && s.Active(now)
+		from := now
+		if s.ExpiresAt != nil && s.ExpiresAt.After(now) {
+			from = *s.ExpiresAt
+		}
+		if change.Plan != "" {
+			if !plans[change.Plan] {
+				return fmt.Errorf("%w: %s", ErrUnknownPlan, change.Plan)
+			}
+			s.Plan = change.Plan
+		}
+		if !s.Active(now) {
+			s.StartedAt = &now
+		}
+		s.Status = SubscriptionActive
+		if change.ExpiresAt != nil || !openEnded {
+			s.ExpiresAt = periodEnd(change.ExpiresAt, from, terms.Period)
+		}
+		s.GraceUntil = nil
+		s.CanceledAt = nil
+		return nil
+	})
+}
+
+// FailSubscriptionPayment marks a membership past due, keeping it for the grace period
+func (db *DB) FailSubscriptionPayment(userID int, terms SubscriptionTerms) (User, error) {
+	return db.updateSubscription(userID, func(s *Subscription, now time.Time) error {
+		if s.Status == "" {
+			return ErrNoSubscription
+		}
+		if !s.Active(now) || s.Status == SubscriptionPastDue {
+			return nil
+		}
+		graceUntil := now.Add(terms.Grace)
+		s.Status = SubscriptionPastDue
+		s.GraceUntil = &graceUntil
+		return nil
+	})
+}
+
+// CancelSubscription stops renewals. The membership lasts until the paid period ends
+func (db *DB) CancelSubscription(userID int) (User, error) {
+	return db.updateSubscription(userID, func(s *Subscription, now time.Time) error {
+		if s.Status == "" {
+			return ErrNoSubscription
+		}
+		if !s.Active(now) {
+			return nil
+		}
+		if s.Status == SubscriptionPastDue || s.ExpiresAt == nil {
+			s.Status = SubscriptionExpired
+			s.ExpiresAt = &now
+			s.GraceUntil = nil
+		} else {
+			s.Status = SubscriptionCanceled
+		}
+		s.CanceledAt = &now
+		return nil
+	})
+}
+
+// EndSubscription ends a membership immediately
+func (db *DB) EndSubscription(userID int) (User, error) {
+	return db.updateSubscription(userID, func(s *Subscription, now time.Time) error {
+		if s.Status == "" {
+			return ErrNoSubscription
+		}
+		if s.Status != SubscriptionExpired {
+			s.Status = SubscriptionExpired
+			s.ExpiresAt = &now
+			s.GraceUntil = nil
+		}
+		return nil
+	})
+}
+
+// ExpireSubscriptions marks the memberships that have lapsed as expired
+func (db *DB) ExpireSubscriptions() error {
+	return db.update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		expired := 0
+		for id, user := range dbStructure.Users {
+			lapsed, err := dbStructure.lapseSubscription(&user, now)
+			if err != nil {
+				return err
+			}
+			if lapsed {
+				dbStructure.Users[id] = user
+				expired++
+			}
+		}
+		if expired == 0 {
+			return errNoChange
+		}
+		return nil
+	})
+}
+
+// updateSubscription applies update to a user's subscription and queues
+// EventUserUpgraded or EventUserDowngraded when that changes their plan
+func (db *DB) updateSubscription(userID int, update func(s *Subscription, now time.Time) error) (User, error) {
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("%w: %v", ErrUserNotFound, userID)
+		}
+
+		now := time.Now().UTC()
+		// a membership that ran out before the scheduler noticed still ends with an event
+		_, err := dbStructure.lapseSubscription(&user, now)
+		if err != nil {
+			return err
+		}
+		wasActive := user.Subscription.Active(now)
+		err = update(&user.Subscription, now)
+		if err != nil {
+			return err
+		}
+		dbStructure.Users[userID] = user
+		switch isActive := user.Subscription.Active(now); {
+		case isActive && !wasActive:
+			return dbStructure.enqueueEvent(EventUserUpgraded, userID, planEvent(user, now))
+		case wasActive && !isActive:
+			return dbStructure.enqueueEvent(EventUserDowngraded, userID, planEvent(user, now))
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// lapseSubscription marks a membership that is no longer active as expired and
+// queues EventUserDowngraded, reporting whether it did
+func (dbStructure *DBStructure) lapseSubscription(user *User, now time.Time) (bool, error) {
+	s := user.Subscription
+	if s.Status == "" || s.Status == SubscriptionExpired || s.Active(now) {
+		return false, nil
+	}
+	user.Subscription.Status = SubscriptionExpired
+	return true, dbStructure.enqueueEvent(EventUserDowngraded, user.ID, planEvent(*user, now))
+}
+
+func periodEnd(expiresAt *time.Time, from time.Time, period time.Duration) *time.Time {
+	if expiresAt != nil {
+		end := expiresAt.UTC()
+		return &end
+	}
+	end := from.Add(period)
+	return &end
+}
+
+// planEvent is the data of EventUserUpgraded and EventUserDowngraded
+func planEvent(user User, now time.Time) interface{} {
+	plan := PlanFree
+	if user.Subscription.Active(now) {
+		plan = user.Subscription.Plan
+	}
+	return struct {
+		UserID      int    `json:"user_id"`
+		Plan        string `json:"plan"`
+		IsChirpyRed bool   `json:"is_chirpy_red"`
+	}{
+		UserID:      user.ID,
+		Plan:        plan,
+		IsChirpyRed: plan == PlanChirpyRed,
+	}
+}
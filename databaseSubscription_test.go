@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testTerms = SubscriptionTerms{Period: 30 * 24 * time.Hour, Grace: 3 * 24 * time.Hour}
+
+func TestStartSubscriptionWithoutExpiryIsOpenEnded(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+
+	user, err := db.StartSubscription(user.ID, SubscriptionChange{}, testTerms)
+	if err != nil {
+		t.Fatalf("StartSubscription: %v", err)
+	}
+	if user.Subscription.ExpiresAt != nil {
+		t.Errorf("subscription expires at %s, want it open-ended", user.Subscription.ExpiresAt)
+	}
+	if !user.Subscription.Active(time.Now().Add(365 * 24 * time.Hour)) {
+		t.Error("subscription isn't active a year later")
+	}
+
+	user, err = db.RenewSubscription(user.ID, SubscriptionChange{}, testTerms)
+	if err != nil {
+		t.Fatalf("RenewSubscription: %v", err)
+	}
+	if user.Subscription.ExpiresAt != nil {
+		t.Errorf("renewed subscription expires at %s, want it still open-ended", user.Subscription.ExpiresAt)
+	}
+}
+
+func TestSubscriptionExpiry(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	expiresAt := time.Now().Add(7 * 24 * time.Hour).UTC().Truncate(time.Second)
+
+	user, err := db.StartSubscription(user.ID, SubscriptionChange{ExpiresAt: &expiresAt}, testTerms)
+	if err != nil {
+		t.Fatalf("StartSubscription: %v", err)
+	}
+	if user.Subscription.ExpiresAt == nil || !user.Subscription.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("subscription expires at %v, want %s", user.Subscription.ExpiresAt, expiresAt)
+	}
+
+	// renewing without an expiry extends the paid period
+	user, err = db.RenewSubscription(user.ID, SubscriptionChange{}, testTerms)
+	if err != nil {
+		t.Fatalf("RenewSubscription: %v", err)
+	}
+	want := expiresAt.Add(testTerms.Period)
+	if user.Subscription.ExpiresAt == nil || !user.Subscription.ExpiresAt.Equal(want) {
+		t.Errorf("renewed subscription expires at %v, want %s", user.Subscription.ExpiresAt, want)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Events users and admins can subscribe webhooks to
+const EventChirpCreated = "chirp.created"
+const EventChirpDeleted = "chirp.deleted"
+const EventUserUpgraded = "user.upgraded"
+const EventUserDowngraded = "user.downgraded"
+
+var webhookEvents = map[string]bool{
+	EventChirpCreated:   true,
+	EventChirpDeleted:   true,
+	EventUserUpgraded:   true,
+	EventUserDowngraded: true,
+}
+
+// Delivery statuses
+const DeliveryPending = "pending"
+const DeliverySucceeded = "succeeded"
+const DeliveryFailed = "failed"
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is an endpoint events are posted to. A user's webhooks receive events
+// about that user, global webhooks registered by admins receive every event
+type Webhook struct {
+	ID      string   `json:"id"`
+	OwnerID int      `json:"owner_id"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Global  bool     `json:"global"`
+	// Secret signs deliveries and is only shown when the webhook is created
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (hook Webhook) subscribed(event string, userID int) bool {
+	if !hook.Global && hook.OwnerID != userID {
+		return false
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event queued for, or sent to, one webhook
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	EventID   string          `json:"event_id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	// ResponseStatus is the status code of the last attempt, 0 when no response came back
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+func (db *DB) CreateWebhook(hook Webhook) (Webhook, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Webhooks[hook.ID]; ok {
+			return fmt.Errorf("webhook already exists: %v", hook.ID)
+		}
+		dbStructure.Webhooks[hook.ID] = hook
+		if hook.Global {
+			dbStructure.appendAudit(hook.OwnerID, "webhook.created", 0, hook.URL)
+		}
+		return nil
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return hook, nil
+}
+
+// GetWebhook returns a webhook its owner, or an admin, may manage. A userID
+// of 0 is the server, which may read any webhook
+func (db *DB) GetWebhook(id string, userID int) (Webhook, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Webhook{}, err
+	}
+	hook, ok := dbStructure.Webhooks[id]
+	if !ok || (hook.OwnerID != userID && !dbStructure.actorHasRole(userID, RoleAdmin)) {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return hook, nil
+}
+
+// GetWebhooks returns the webhooks owned by userID, or every webhook when userID is 0
+func (db *DB) GetWebhooks(userID int) ([]Webhook, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []Webhook{}
+	for _, hook := range dbStructure.Webhooks {
+		if userID == 0 || hook.OwnerID == userID {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook removes a webhook and its delivery log, dropping deliveries still queued
+func (db *DB) DeleteWebhook(id string, userID int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		hook, ok := dbStructure.Webhooks[id]
+		if !ok || (hook.OwnerID != userID && !dbStructure.actorHasRole(userID, RoleAdmin)) {
+			return ErrWebhookNotFound
+		}
+		delete(dbStructure.Webhooks, id)
+		for deliveryID, delivery := range dbStructure.WebhookDeliveries {
+			if delivery.WebhookID == id {
+				delete(dbStructure.WebhookDeliveries, deliveryID)
+			}
+		}
+		if hook.Global {
+			dbStructure.appendAudit(userID, "webhook.deleted", 0, hook.URL)
+		}
+		return nil
+	})
+}
+
+func (db *DB) GetWebhookDeliveries(webhookID string) ([]WebhookDelivery, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+// DueWebhookDeliveries returns the pending deliveries whose next attempt is due
+func (db *DB) DueWebhookDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt saves the outcome of sending a delivery. The delivery may
+// have been dropped with its webhook while it was being sent
+func (db *DB) RecordWebhookAttempt(attempt WebhookDelivery) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.WebhookDeliveries[attempt.ID]; !ok {
+			return errNoChange
+		}
+		dbStructure.WebhookDeliveries[attempt.ID] = attempt
+		return nil
+	})
+}
+
+// PruneWebhookDeliveries forgets deliveries that completed more than retention ago
+func (db *DB) PruneWebhookDeliveries(retention time.Duration) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		pruned := 0
+		for id, delivery := range dbStructure.WebhookDeliveries {
+			if delivery.CompletedAt != nil && time.Since(*delivery.CompletedAt) > retention {
+				delete(dbStructure.WebhookDeliveries, id)
+				pruned++
+			}
+		}
+		if pruned == 0 {
+			return errNoChange
+		}
+		return nil
+	})
+}
+
+// removeUserWebhooks drops the webhooks a deleted user registered for themselves.
+// Global webhooks belong to the server and are kept
+func (dbStructure *DBStructure) removeUserWebhooks(userID int) {
+	for id, hook := range dbStructure.Webhooks {
+		if hook.OwnerID != userID || hook.Global {
+			continue
+		}
+		delete(dbStructure.Webhooks, id)
+		for deliveryID, delivery := range dbStructure.WebhookDeliveries {
+			if delivery.WebhookID == id {
+				delete(dbStructure.WebhookDeliveries, deliveryID)
+			}
+		}
+	}
+}
+
+// enqueueEvent queues a delivery of event for every webhook subscribed to it.
+// It is called by the methods that make the change, so the event is saved with it
+func (dbStructure *DBStructure) enqueueEvent(event string, userID int, data interface{}) error {
+	eventID, err := newRandomID()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	payload, err := json.Marshal(struct {
+		ID        string      `json:"id"`
+		Type      string      `json:"type"`
+		CreatedAt time.Time   `json:"created_at"`
+		Data      interface{} `json:"data"`
+	}{
+		ID:        eventID,
+		Type:      event,
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range dbStructure.Webhooks {
+		if !hook.subscribed(event, userID) {
+			continue
+		}
+		id, err := newRandomID()
+		if err != nil {
+			return err
+		}
+		dbStructure.WebhookDeliveries[id] = WebhookDelivery{
+			ID:            id,
+			WebhookID:     hook.ID,
+			EventID:       eventID,
+			Event:         event,
+			Payload:       payload,
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+	}
+	return nil
+}
+
+func newRandomID() (string, error) {
+	dat := make([]byte, 16)
+	_, err := rand.Read(dat)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(dat), nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	return db
+}
+
+func createTestUser(t *testing.T, db *DB, email string) User {
+	t.Helper()
+	user, err := db.CreateUser(email, "hash")
+	if err != nil {
+		t.Fatalf("CreateUser(%q): %v", email, err)
+	}
+	return user
+}
+
+// createVerifiedUser creates a user that may post chirps and upload media
+func createVerifiedUser(t *testing.T, db *DB, email string) User {
+	t.Helper()
+	user := createTestUser(t, db, email)
+	err := db.update(func(dbStructure *DBStructure) error {
+		user.IsVerified = true
+		dbStructure.Users[user.ID] = user
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	return user
+}
+
+func TestUpdateKeepsConcurrentWrites(t *testing.T) {
+	db := newTestDB(t)
+
+	const users = 20
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), "hash")
+			if err != nil {
+				t.Errorf("CreateUser: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		t.Fatalf("loadDB: %v", err)
+	}
+	if len(dbStructure.Users) != users {
+		t.Errorf("got %d users, want %d", len(dbStructure.Users), users)
+	}
+	if dbStructure.LastUserID != users {
+		t.Errorf("LastUserID = %d, want %d", dbStructure.LastUserID, users)
+	}
+}
+
+func TestUpdateDiscardsChangesOnError(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		delete(dbStructure.Users, user.ID)
+		return ErrForbidden
+	})
+	if err != ErrForbidden {
+		t.Fatalf("update returned %v, want %v", err, ErrForbidden)
+	}
+	if _, err := db.GetUser(user.ID); err != nil {
+		t.Errorf("user was deleted by a failed update: %v", err)
+	}
+}
+
+func TestResetPasswordIsSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	if err := db.CreatePasswordReset(user.ID, "reset", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("CreatePasswordReset: %v", err)
+	}
+
+	const resets = 10
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	succeeded := 0
+	for i := 0; i < resets; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.ResetPassword("reset", fmt.Sprintf("hash-%d", i))
+			if err == nil {
+				mux.Lock()
+				succeeded++
+				mux.Unlock()
+			} else if !errors.Is(err, ErrInvalidResetToken) {
+				t.Errorf("ResetPassword: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Errorf("the reset token was used %d times, want 1", succeeded)
+	}
+	if _, err := db.FindPasswordReset("reset"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("FindPasswordReset after use: got %v, want %v", err, ErrInvalidResetToken)
+	}
+}
+
+func TestResetPasswordRevokesSessions(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	other := createTestUser(t, db, "jesse@example.com")
+	startTestSession(t, db, user.ID, "first")
+	startTestSession(t, db, user.ID, "second")
+	startTestSession(t, db, other.ID, "other")
+	if _, err := db.RotateRefreshToken("first", "rotated", "127.0.0.1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+	if err := db.CreatePasswordReset(user.ID, "reset", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("CreatePasswordReset: %v", err)
+	}
+
+	if _, err := db.ResetPassword("reset", "new-hash"); err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+	sessions, err := db.GetSessions(user.ID)
+	if err != nil {
+		t.Fatalf("GetSessions: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("got %d sessions after a reset, want 0", len(sessions))
+	}
+	for _, hash := range []string{"rotated", "second"} {
+		_, err := db.RotateRefreshToken(hash, hash+"-next", "127.0.0.1", time.Now().Add(time.Hour))
+		if !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("refresh token %q after a reset: got %v, want %v", hash, err, ErrInvalidRefreshToken)
+		}
+	}
+	if sessions, _ := db.GetSessions(other.ID); len(sessions) != 1 {
+		t.Errorf("another user's sessions were revoked")
+	}
+}
+
+func TestDeleteUserAnonymizesChirpMedia(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	if _, err := db.CreateMedia(Media{ID: "photo", OwnerID: user.ID, Key: "photo.png"}); err != nil {
+		t.Fatalf("CreateMedia: %v", err)
+	}
+	chirp, err := db.CreateChirp("say my name", user.ID, []string{"photo"})
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+
+	media, err := db.DeleteUser(user.ID, true)
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if len(media) != 1 || media[0].ID != "photo" {
+		t.Errorf("DeleteUser returned media %+v, want the user's upload", media)
+	}
+	chirp, err = db.GetChirp(chirp.ID, 0)
+	if err != nil {
+		t.Fatalf("GetChirp: %v", err)
+	}
+	if chirp.AuthorId != 0 || len(chirp.MediaIDs) != 0 {
+		t.Errorf("anonymized chirp = %+v, want no author or media", chirp)
+	}
+}
+
+func TestRestoreChirpWithinUndoWindow(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	chirp, err := db.CreateChirp("say my name", user.ID, nil)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+
+	if err := db.DeleteChirp(chirp.ID, user.ID); err != nil {
+		t.Fatalf("DeleteChirp: %v", err)
+	}
+	if _, err := db.GetChirp(chirp.ID, 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetChirp of a deleted chirp: got %v, want %v", err, ErrNotFound)
+	}
+	if chirps, _ := db.GetChirps(0); len(chirps) != 0 {
+		t.Errorf("GetChirps listed %d deleted chirps, want 0", len(chirps))
+	}
+	if err := db.DeleteChirp(chirp.ID, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting twice: got %v, want %v", err, ErrNotFound)
+	}
+	// purging keeps chirps that can still be restored
+	if err := db.PurgeDeletedChirps(time.Minute); err != nil {
+		t.Fatalf("PurgeDeletedChirps: %v", err)
+	}
+
+	restored, err := db.RestoreChirp(chirp.ID, user.ID, time.Minute)
+	if err != nil {
+		t.Fatalf("RestoreChirp: %v", err)
+	}
+	if restored.DeletedAt != nil || restored.Body != chirp.Body {
+		t.Errorf("restored chirp = %+v, want %+v", restored, chirp)
+	}
+	if _, err := db.GetChirp(chirp.ID, 0); err != nil {
+		t.Errorf("GetChirp of a restored chirp: %v", err)
+	}
+	if _, err := db.RestoreChirp(chirp.ID, user.ID, time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restoring a chirp that isn't deleted: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRestoreChirpAfterUndoWindow(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	chirp, err := db.CreateChirp("say my name", user.ID, nil)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	if err := db.DeleteChirp(chirp.ID, user.ID); err != nil {
+		t.Fatalf("DeleteChirp: %v", err)
+	}
+
+	if _, err := db.RestoreChirp(chirp.ID, user.ID, 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restoring after the undo window: got %v, want %v", err, ErrNotFound)
+	}
+	if err := db.PurgeDeletedChirps(0); err != nil {
+		t.Fatalf("PurgeDeletedChirps: %v", err)
+	}
+	if chirps, _ := db.GetUserChirps(user.ID); len(chirps) != 0 {
+		t.Errorf("%d chirps are left after the purge, want 0", len(chirps))
+	}
+	if _, err := db.RestoreChirp(chirp.ID, user.ID, time.Hour); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restoring a purged chirp: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRestoreChirpOfAnotherUser(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	other := createTestUser(t, db, "jesse@example.com")
+	chirp, err := db.CreateChirp("say my name", user.ID, nil)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	if err := db.DeleteChirp(chirp.ID, user.ID); err != nil {
+		t.Fatalf("DeleteChirp: %v", err)
+	}
+	if _, err := db.RestoreChirp(chirp.ID, other.ID, time.Minute); !errors.Is(err, ErrForbidden) {
+		t.Errorf("RestoreChirp by another user: got %v, want %v", err, ErrForbidden)
+	}
+	if _, err := db.SetRole(0, other.ID, RoleModerator); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	if _, err := db.RestoreChirp(chirp.ID, other.ID, time.Minute); err != nil {
+		t.Errorf("RestoreChirp by a moderator: %v", err)
+	}
+}
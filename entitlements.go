@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Capabilities name the premium features, as reported in the X-Entitlement header
+const CapLongChirps = "long_chirps"
+const CapEditChirps = "edit_chirps"
+const CapAttachMedia = "attach_media"
+const CapHigherRateLimit = "higher_rate_limit"
+
+const entitlementHeader = "X-Entitlement"
+
+// Entitlements are what a plan lets its users do
+type Entitlements struct {
+	Plan           string `json:"plan"`
+	MaxChirpLength int    `json:"max_chirp_length"`
+	EditChirps     bool   `json:"edit_chirps"`
+	AttachMedia    bool   `json:"attach_media"`
+	// RequestsPerMinute limits the authenticated requests a user can make
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// has reports whether e grants capability, the limits counting when they are
+// above those of the free plan
+func (e Entitlements) has(capability string, free Entitlements) bool {
+	switch capability {
+	case CapLongChirps:
+		return e.MaxChirpLength > free.MaxChirpLength
+	case CapEditChirps:
+		return e.EditChirps
+	case CapAttachMedia:
+		return e.AttachMedia
+	case CapHigherRateLimit:
+		return e.RequestsPerMinute > free.RequestsPerMinute
+	default:
+		return false
+	}
+}
+
+var defaultPlanEntitlements = map[string]Entitlements{
+	PlanFree: {
+		Plan:              PlanFree,
+		MaxChirpLength:    140,
+		RequestsPerMinute: 60,
+	},
+	PlanChirpyRed: {
+		Plan:              PlanChirpyRed,
+		MaxChirpLength:    1000,
+		EditChirps:        true,
+		AttachMedia:       true,
+		RequestsPerMinute: 600,
+	},
+}
+
+// EntitlementService decides what each user may do from their plan
+type EntitlementService struct {
+	db    *DB
+	plans map[string]Entitlements
+}
+
+func NewEntitlementService(db *DB, plans map[string]Entitlements) *EntitlementService {
+	return &EntitlementService{
+		db:    db,
+		plans: plans,
+	}
+}
+
+// For returns the entitlements of the user's current plan
+func (s *EntitlementService) For(user User) Entitlements {
+	entitlements, ok := s.plans[user.Plan()]
+	if !ok {
+		return s.plans[PlanFree]
+	}
+	return entitlements
+}
+
+// ForUser is For looked up by ID from the database's snapshot, as it's
+// needed on every authenticated request
+func (s *EntitlementService) ForUser(userID int) (Entitlements, error) {
+	dbStructure, err := s.db.cached()
+	if err != nil {
+		return Entitlements{}, err
+	}
+	user, ok := dbStructure.Users[userID]
+	if !ok {
+		return Entitlements{}, fmt.Errorf("%w: %v", ErrUserNotFound, userID)
+	}
+	return s.For(user), nil
+}
+
+// Check reports whether e grants capability. When it doesn't and a paid plan
+// does, the X-Entitlement header tells the client which plan to upgrade to,
+// the first by name when several do
+func (s *EntitlementService) Check(w http.ResponseWriter, e Entitlements, capability string) bool {
+	free := s.plans[PlanFree]
+	if e.has(capability, free) {
+		return true
+	}
+	paid := []string{}
+	for plan := range s.plans {
+		if plan != PlanFree {
+			paid = append(paid, plan)
+		}
+	}
+	sort.Strings(paid)
+	for _, plan := range paid {
+		if s.plans[plan].has(capability, free) {
+			w.Header().Set(entitlementHeader, fmt.Sprintf(`%s; plan="%s"`, capability, plan))
+			break
+		}
+	}
+	return false
+}
+
+// Require is Check for features that are refused outright, responding with 403
+func (s *EntitlementService) Require(w http.ResponseWriter, e Entitlements, capability string, feature string) bool {
+	if s.Check(w, e, capability) {
+		return true
+	}
+	respondWithAPIError(w, newAPIError(http.StatusForbidden, CodeEntitlementRequired, feature+" isn't included in your plan"))
+	return false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAttachingMediaRequiresChirpyRed(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	blobs, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileBlobStore: %v", err)
+	}
+	cfg.Blobs = blobs
+	user := createVerifiedUser(t, cfg.DB, "walt@example.com")
+
+	// free users upload their avatars
+	rec := uploadTestImage(t, cfg, user.ID)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload: got %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var media mediaResponse
+	if err := json.NewDecoder(rec.Body).Decode(&media); err != nil {
+		t.Fatalf("malformed upload response: %v", err)
+	}
+	if _, err := cfg.DB.ChangeUser(user.ID, UserChanges{AvatarMediaID: &media.ID}); err != nil {
+		t.Fatalf("ChangeUser: %v", err)
+	}
+
+	createChirp := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"body": "say my name", "media_ids": []string{media.ID}})
+		req := authenticated(httptest.NewRequest(http.MethodPost, "/api/chirps", bytes.NewReader(body)), user.ID)
+		rec := httptest.NewRecorder()
+		cfg.handlerChirpsCreate(rec, req)
+		return rec
+	}
+	rec = createChirp()
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("attaching as a free user: got %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+	if got, want := rec.Header().Get(entitlementHeader), `attach_media; plan="chirpy_red"`; got != want {
+		t.Errorf("%s = %q, want %q", entitlementHeader, got, want)
+	}
+
+	if _, err := cfg.DB.StartSubscription(user.ID, SubscriptionChange{}, testTerms); err != nil {
+		t.Fatalf("StartSubscription: %v", err)
+	}
+	if rec := createChirp(); rec.Code != http.StatusCreated {
+		t.Errorf("attaching with Chirpy Red: got %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+}
+
+func TestForUserFollowsPlanChanges(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+
+	entitlements, err := cfg.Entitlements.ForUser(user.ID)
+	if err != nil {
+		t.Fatalf("ForUser: %v", err)
+	}
+	if entitlements.Plan != PlanFree {
+		t.Errorf("plan = %q, want %q", entitlements.Plan, PlanFree)
+	}
+
+	if _, err := cfg.DB.StartSubscription(user.ID, SubscriptionChange{}, testTerms); err != nil {
+		t.Fatalf("StartSubscription: %v", err)
+	}
+	entitlements, err = cfg.Entitlements.ForUser(user.ID)
+	if err != nil {
+		t.Fatalf("ForUser: %v", err)
+	}
+	if entitlements.Plan != PlanChirpyRed {
+		t.Errorf("plan after upgrading = %q, want %q", entitlements.Plan, PlanChirpyRed)
+	}
+
+	if _, err := cfg.Entitlements.ForUser(user.ID + 1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("ForUser of an unknown user: got %v, want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestCheckNamesTheSamePaidPlanEveryTime(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	free := defaultPlanEntitlements[PlanFree]
+	service := NewEntitlementService(cfg.DB, map[string]Entitlements{
+		PlanFree:      free,
+		"chirpy_gold": {Plan: "chirpy_gold", MaxChirpLength: 1000, EditChirps: true, RequestsPerMinute: 600},
+		"chirpy_blue": {Plan: "chirpy_blue", MaxChirpLength: 500, EditChirps: true, RequestsPerMinute: 600},
+	})
+
+	// map iteration order changes between runs, so ask often enough to notice
+	for i := 0; i < 50; i++ {
+		rec := httptest.NewRecorder()
+		if service.Check(rec, free, CapEditChirps) {
+			t.Fatal("the free plan was granted edit_chirps")
+		}
+		if got, want := rec.Header().Get(entitlementHeader), `edit_chirps; plan="chirpy_blue"`; got != want {
+			t.Fatalf("%s = %q, want %q", entitlementHeader, got, want)
+		}
+	}
+
+	// plans that don't grant the capability aren't suggested
+	rec := httptest.NewRecorder()
+	if service.Check(rec, free, CapAttachMedia) {
+		t.Fatal("the free plan was granted attach_media")
+	}
+	if got := rec.Header().Get(entitlementHeader); got != "" {
+		t.Errorf("%s = %q, want none when no plan grants attach_media", entitlementHeader, got)
+	}
+}
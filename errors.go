@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Error codes are part of the API. Clients match on them, never on the detail text
+const CodeBadRequest = "bad_request"
+const CodeUnauthorized = "unauthorized"
+const CodeForbidden = "forbidden"
+const CodeNotFound = "not_found"
+const CodeConflict = "conflict"
+const CodePayloadTooLarge = "payload_too_large"
+const CodeUnsupportedMediaType = "unsupported_media_type"
+const CodeValidationFailed = "validation_failed"
+const CodeInternal = "internal_error"
+const CodeUnavailable = "service_unavailable"
+const CodeInvalidCredentials = "invalid_credentials"
+const CodeInvalidToken = "invalid_token"
+const CodeInvalidSignature = "invalid_signature"
+const CodeRefreshTokenReused = "refresh_token_reused"
+const CodeInvalidMFACode = "invalid_mfa_code"
+const CodeMFAEnabled = "mfa_already_enabled"
+const CodeMFANotEnabled = "mfa_not_enabled"
+const CodeMFALocked = "mfa_locked"
+const CodeEmailNotVerified = "email_not_verified"
+const CodeAlreadyVerified = "email_already_verified"
+const CodeEmailTaken = "email_taken"
+const CodeHandleTaken = "handle_taken"
+const CodeUserNotFound = "user_not_found"
+const CodeChirpNotFound = "chirp_not_found"
+const CodeMediaNotFound = "media_not_found"
+const CodeSessionNotFound = "session_not_found"
+const CodeWebhookNotFound = "webhook_not_found"
+const CodeEventNotFound = "event_not_found"
+const CodeEventProcessed = "event_already_processed"
+const CodeEventInProgress = "event_in_progress"
+const CodeInvalidEvent = "invalid_event"
+const CodeEntitlementRequired = "entitlement_required"
+const CodeRateLimited = "rate_limited"
+const CodeBlocked = "blocked"
+
+// statusCodes is the code used for errors that don't have a more specific one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   CodeValidationFailed,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// APIError is an error response, rendered as RFC 9457 problem details
+type APIError struct {
+	Status int
+	Code   string
+	// Title summarizes the code and defaults to the status text
+	Title  string
+	Detail string
+	Fields []FieldError
+	// Cause is logged with the request ID and never sent to the client
+	Cause error
+}
+
+func (e *APIError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Detail, e.Cause)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
+
+func newAPIError(status int, code, detail string) *APIError {
+	return &APIError{
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// respondWithAPIError writes e as application/problem+json. Server errors only
+// tell the client something went wrong, the details go to the log
+func respondWithAPIError(w http.ResponseWriter, e *APIError) {
+	requestID := w.Header().Get(requestIDHeader)
+	detail := e.Detail
+	if e.Status > 499 {
+		log.Printf("Responding with 5XX error (request %s): %s", requestID, e)
+		detail = serverFailed
+	} else if e.Cause != nil {
+		log.Printf("Responding with %d (request %s): %s", e.Status, requestID, e)
+	}
+	code := e.Code
+	if code == "" {
+		code = statusCodes[e.Status]
+		if code == "" {
+			code = CodeInternal
+		}
+	}
+	title := e.Title
+	if title == "" {
+		title = http.StatusText(e.Status)
+	}
+
+	type problem struct {
+		Type      string       `json:"type"`
+		Title     string       `json:"title"`
+		Status    int          `json:"status"`
+		Detail    string       `json:"detail,omitempty"`
+		Code      string       `json:"code"`
+		RequestID string       `json:"request_id,omitempty"`
+		Fields    []FieldError `json:"fields,omitempty"`
+	}
+	dat, err := json.Marshal(problem{
+		Type:      "urn:chirpy:error:" + code,
+		Title:     title,
+		Status:    e.Status,
+		Detail:    detail,
+		Code:      code,
+		RequestID: requestID,
+		Fields:    e.Fields,
+	})
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		w.Write([]byte(serverFailed))
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(e.Status)
+	w.Write(dat)
+}
+
+// respondWithAuthError renders the errors of the auth middleware, which can't
+// use respondWithAPIError from its own package
+func respondWithAuthError(w http.ResponseWriter, status int, code, detail string) {
+	respondWithAPIError(w, newAPIError(status, code, detail))
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// middlewareRequestID tags every request with an ID, keeping a well formed one
+// sent by the client, and echoes it in the response so errors can be traced in the logs
+func middlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			dat := make([]byte, 8)
+			rand.Read(dat)
+			requestID = hex.EncodeToString(dat)
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type testProblem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id"`
+	Fields    []FieldError `json:"fields"`
+}
+
+func decodeProblem(t *testing.T, rec *httptest.ResponseRecorder) testProblem {
+	t.Helper()
+	if got := rec.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", got)
+	}
+	var problem testProblem
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("malformed problem %s: %v", rec.Body, err)
+	}
+	return problem
+}
+
+func TestRespondWithAPIError(t *testing.T) {
+	fields := []FieldError{{Field: "email", Rule: RuleFormat, Message: "email must be an email address"}}
+	tests := []struct {
+		name string
+		err  *APIError
+		want testProblem
+	}{
+		{
+			name: "specific code",
+			err:  newAPIError(http.StatusConflict, CodeEmailTaken, "email is already in use"),
+			want: testProblem{Type: "urn:chirpy:error:email_taken", Title: "Conflict", Status: http.StatusConflict, Detail: "email is already in use", Code: CodeEmailTaken},
+		},
+		{
+			name: "code from the status",
+			err:  newAPIError(http.StatusNotFound, "", "no such thing"),
+			want: testProblem{Type: "urn:chirpy:error:not_found", Title: "Not Found", Status: http.StatusNotFound, Detail: "no such thing", Code: CodeNotFound},
+		},
+		{
+			name: "field errors",
+			err:  &APIError{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Detail: "request is invalid", Fields: fields},
+			want: testProblem{Type: "urn:chirpy:error:validation_failed", Title: "Unprocessable Entity", Status: http.StatusUnprocessableEntity, Detail: "request is invalid", Code: CodeValidationFailed, Fields: fields},
+		},
+		{
+			name: "custom title",
+			err:  &APIError{Status: http.StatusForbidden, Code: CodeEntitlementRequired, Title: "Upgrade required", Detail: "needs Chirpy Red"},
+			want: testProblem{Type: "urn:chirpy:error:entitlement_required", Title: "Upgrade required", Status: http.StatusForbidden, Detail: "needs Chirpy Red", Code: CodeEntitlementRequired},
+		},
+		{
+			// server errors never leak their detail or cause
+			name: "server error",
+			err:  &APIError{Status: http.StatusInternalServerError, Detail: "couldn't write database.json", Cause: errors.New("disk full")},
+			want: testProblem{Type: "urn:chirpy:error:internal_error", Title: "Internal Server Error", Status: http.StatusInternalServerError, Detail: serverFailed, Code: CodeInternal},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rec.Header().Set(requestIDHeader, "request-1")
+			respondWithAPIError(rec, tt.err)
+
+			if rec.Code != tt.want.Status {
+				t.Errorf("got %d, want %d", rec.Code, tt.want.Status)
+			}
+			tt.want.RequestID = "request-1"
+			if problem := decodeProblem(t, rec); !reflect.DeepEqual(problem, tt.want) {
+				t.Errorf("problem = %+v, want %+v", problem, tt.want)
+			}
+			if strings.Contains(rec.Body.String(), "disk full") {
+				t.Errorf("the cause was sent to the client: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	generated := regexp.MustCompile(`^[0-9a-f]{16}$`)
+	tests := []struct {
+		name string
+		sent string
+		keep bool
+	}{
+		{name: "well formed", sent: "client-request.1", keep: true},
+		{name: "missing", sent: ""},
+		{name: "malformed", sent: "not a request id\n"},
+		{name: "too long", sent: strings.Repeat("a", 65)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := middlewareRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				seen = req.Header.Get(requestIDHeader)
+				respondWithError(w, http.StatusNotFound, "no such thing")
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/chirps/1", nil)
+			if tt.sent != "" {
+				req.Header.Set(requestIDHeader, tt.sent)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			requestID := rec.Header().Get(requestIDHeader)
+			if tt.keep && requestID != tt.sent {
+				t.Errorf("request ID = %q, want the client's %q", requestID, tt.sent)
+			}
+			if !tt.keep && !generated.MatchString(requestID) {
+				t.Errorf("request ID = %q, want a generated one", requestID)
+			}
+			if seen != requestID {
+				t.Errorf("handler saw request ID %q, want %q", seen, requestID)
+			}
+			if problem := decodeProblem(t, rec); problem.RequestID != requestID {
+				t.Errorf("problem request_id = %q, want %q", problem.RequestID, requestID)
+			}
+		})
+	}
+}
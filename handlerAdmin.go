@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+type adminUserResponse struct {
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	Handle      string `json:"handle"`
+	Role        string `json:"role"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	IsVerified  bool   `json:"is_verified"`
+}
+
+func newAdminUserResponse(user User) adminUserResponse {
+	return adminUserResponse{
+		ID:          user.ID,
+		Email:       user.Email,
+		Handle:      user.Handle,
+		Role:        user.RoleOrDefault(),
+		IsChirpyRed: user.IsChirpyRed(),
+		IsVerified:  user.IsVerified,
+	}
+}
+
+func (cfg *apiConfig) handlerAdminUsersGet(w http.ResponseWriter, req *http.Request) {
+	users, err := cfg.DB.GetUsers()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve users")
+		return
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	resp := make([]adminUserResponse, 0, len(users))
+	for _, user := range users {
+		resp = append(resp, newAdminUserResponse(user))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerAdminUsersRole(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	actorID := principal.UserID
+	userID, err := strconv.Atoi(req.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse user ID")
+		return
+	}
+	if userID == actorID {
+		respondWithError(w, http.StatusBadRequest, "admins can't change their own role")
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	if errs.required("role", params.Role) {
+		if _, ok := roleRanks[params.Role]; !ok {
+			errs.add("role", RuleInvalid, fmt.Sprintf("role must be one of %s, %s or %s", RoleUser, RoleModerator, RoleAdmin))
+		}
+	}
+	if !errs.ok(w) {
+		return
+	}
+
+	user, err := cfg.DB.SetRole(actorID, userID, params.Role)
+	if errors.Is(err, ErrInvalidRole) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update role")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newAdminUserResponse(user))
+}
+
+func (cfg *apiConfig) handlerAdminUsersDelete(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	actorID := principal.UserID
+	userID, err := strconv.Atoi(req.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse user ID")
+		return
+	}
+	if userID == actorID {
+		respondWithError(w, http.StatusBadRequest, "use DELETE /api/users to delete your own account")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	err = cfg.deleteUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete user")
+		return
+	}
+	err = cfg.DB.RecordAudit(actorID, "user.deleted", userID, fmt.Sprintf("%s (%s)", user.Email, user.RoleOrDefault()))
+	if err != nil {
+		log.Printf("Couldn't record deletion of user %v in the audit log: %s", userID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerAdminAuditGet(w http.ResponseWriter, req *http.Request) {
+	entries, err := cfg.DB.GetAuditLog()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve audit log")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, entries)
+}
@@ -1,54 +1,66 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 
 	"github.com/janmmiranda/chripy/internal/auth"
 )
 
+const maxChirpMedia = 4
+
 func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
-		Body string `json:"body`
+		Body     string   `json:"body"`
+		MediaIDs []string `json:"media_ids"`
 	}
 
-	bearerToken, err := auth.GetBearerToken(req.Header, BEARER)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-	userIDString, issuer, err := auth.ValidateJWT(bearerToken, cfg.JWTSecret)
+
+	userID := principal.UserID
+	user, err := cfg.DB.GetUser(userID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusUnauthorized, "user not found")
 		return
 	}
-	if issuer == RefreshIssuer {
-		respondWithError(w, http.StatusUnauthorized, "refresh token not accepted for updates")
+	entitlements := cfg.Entitlements.For(user)
+	// uploads are free for avatars, attaching them to chirps is a premium feature
+	if len(params.MediaIDs) > 0 && !cfg.Entitlements.Require(w, entitlements, CapAttachMedia, "attaching media to chirps") {
 		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+	errs := fieldErrors{}
+	cleaned := cfg.validateChirp(w, &errs, entitlements, params.Body, len(params.MediaIDs) > 0)
+	if len(params.MediaIDs) > maxChirpMedia {
+		errs.add("media_ids", RuleTooLong, fmt.Sprintf("a chirp can have at most %d attachments", maxChirpMedia))
+	}
+	if !errs.ok(w) {
 		return
 	}
-
-	cleaned, err := validateChirp(params.Body)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+	if !user.IsVerified {
+		respondWithAPIError(w, newAPIError(http.StatusForbidden, CodeEmailNotVerified, "email must be verified before posting chirps"))
 		return
 	}
-	userIdStr, err := strconv.Atoi(userIDString)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	chirp, err := cfg.DB.CreateChirp(cleaned, userID, params.MediaIDs)
+	if errors.Is(err, ErrInvalidMedia) {
+		respondWithAPIError(w, newAPIError(http.StatusBadRequest, CodeMediaNotFound, err.Error()))
+		return
+	}
+	if errors.Is(err, ErrBlocked) {
+		respondWithAPIError(w, newAPIError(http.StatusForbidden, CodeBlocked, "can't mention a user who blocked you"))
 		return
 	}
-	chirp, err := cfg.DB.CreateChirp(cleaned, userIdStr)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
 		return
@@ -57,24 +69,31 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, req *http.Reque
 		ID:       chirp.ID,
 		Body:     chirp.Body,
 		AuthorId: chirp.AuthorId,
+		MediaIDs: chirp.MediaIDs,
+		Author: &AuthorSummary{
+			ID:          user.ID,
+			Handle:      user.Handle,
+			DisplayName: user.DisplayName,
+		},
 	})
 }
 
-func validateChirp(body string) (string, error) {
-	if !maxChirpLength(body) {
-		return "", errors.New("Chirp is too long")
+// validateChirp checks the body, which may only be empty when the chirp has
+// attachments and can be as long as the author's plan allows, and returns it
+// with filtered words masked
+func (cfg *apiConfig) validateChirp(w http.ResponseWriter, errs *fieldErrors, entitlements Entitlements, body string, hasMedia bool) string {
+	maxChirpLength := entitlements.MaxChirpLength
+	if !hasMedia {
+		errs.required("body", body)
 	}
-
-	return filterChrip(body), nil
-
-}
-
-func maxChirpLength(chrip string) bool {
-	const maxChirpLength = 140
-	return len(chrip) <= maxChirpLength
+	if len(body) > maxChirpLength {
+		cfg.Entitlements.Check(w, entitlements, CapLongChirps)
+	}
+	errs.maxLength("body", body, maxChirpLength)
+	return filterChrip(body, cfg.FilterWords)
 }
 
-func filterChrip(chirp string) string {
+func filterChrip(chirp string, filterWords []string) string {
 	filterSet := make(map[string]bool)
 	for _, word := range filterWords {
 		filterSet[strings.ToLower(word)] = true
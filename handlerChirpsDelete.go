@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -9,43 +10,69 @@ import (
 )
 
 func (cfg *apiConfig) handlerChirpsDelete(w http.ResponseWriter, req *http.Request) {
-	bearerToken, err := auth.GetBearerToken(req.Header, APIKEY)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
 		return
 	}
-	userIDString, issuer, err := auth.ValidateJWT(bearerToken, cfg.JWTSecret)
+	chirpID := req.PathValue("chirpID")
+	iChirpID, err := strconv.Atoi(chirpID)
 	if err != nil {
-		fmt.Printf("unable to validate token %v\n", bearerToken)
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't parse ID: %v", chirpID))
 		return
 	}
-	if issuer == RefreshIssuer {
-		respondWithError(w, http.StatusUnauthorized, "refresh token not accepted for updates")
+
+	err = cfg.DB.DeleteChirp(iChirpID, principal.UserID)
+	if err != nil {
+		respondWithChirpError(w, err, "Couldn't delete chirp")
 		return
 	}
 
-	userId, errr := strconv.Atoi(userIDString)
-	if errr != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't conver userID")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerChirpsRestore(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
 		return
 	}
 	chirpID := req.PathValue("chirpID")
 	iChirpID, err := strconv.Atoi(chirpID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't parse ID: %v", chirpID))
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't parse ID: %v", chirpID))
 		return
 	}
 
-	isDeleted, err := cfg.DB.DeleteChirp(iChirpID, userId)
+	chirp, err := cfg.DB.RestoreChirp(iChirpID, principal.UserID, cfg.ChirpUndoWindow)
 	if err != nil {
-		respondWithError(w, http.StatusForbidden, err.Error())
+		respondWithChirpError(w, err, "Couldn't restore chirp")
 		return
 	}
-	if !isDeleted {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+
+	chirps, err := cfg.withAuthors([]Chirp{{
+		ID:       chirp.ID,
+		Body:     chirp.Body,
+		AuthorId: chirp.AuthorId,
+		MediaIDs: chirp.MediaIDs,
+		EditedAt: chirp.EditedAt,
+	}})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve author")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, response{})
+	respondWithJSON(w, http.StatusOK, chirps[0])
+}
+
+// respondWithChirpError maps data layer errors to their status codes
+func respondWithChirpError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeChirpNotFound, "chirp not found"))
+	case errors.Is(err, ErrForbidden):
+		respondWithAPIError(w, newAPIError(http.StatusForbidden, CodeForbidden, "only the author can change this chirp"))
+	default:
+		respondWithError(w, http.StatusInternalServerError, msg)
+	}
 }
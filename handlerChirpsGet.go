@@ -27,7 +27,7 @@ func (cfg *apiConfig) handlerChirpsGet(w http.ResponseWriter, req *http.Request)
 		sortingOrder = ASC
 	}
 
-	dbChirps, err := cfg.DB.GetChirps(authorId)
+	dbChirps, err := cfg.DB.GetChirps(viewerID(req), authorId)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
 		return
@@ -36,10 +36,18 @@ func (cfg *apiConfig) handlerChirpsGet(w http.ResponseWriter, req *http.Request)
 	chirps := []Chirp{}
 	for _, dbChirp := range dbChirps {
 		chirps = append(chirps, Chirp{
-			ID:   dbChirp.ID,
-			Body: dbChirp.Body,
+			ID:       dbChirp.ID,
+			Body:     dbChirp.Body,
+			AuthorId: dbChirp.AuthorId,
+			MediaIDs: dbChirp.MediaIDs,
+			EditedAt: dbChirp.EditedAt,
 		})
 	}
+	chirps, err = cfg.withAuthors(chirps)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve authors")
+		return
+	}
 
 	if sortingOrder == DESC {
 		sort.Slice(chirps, func(i, j int) bool {
@@ -63,18 +71,26 @@ func (cfg *apiConfig) handlerChirpGet(w http.ResponseWriter, req *http.Request)
 	chirpID := req.PathValue("chirpID")
 	iChirpID, err := strconv.Atoi(chirpID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't parse ID: %v", chirpID))
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't parse ID: %v", chirpID))
 		return
 	}
-	dbChirp, err := cfg.DB.GetChirp(iChirpID)
+	dbChirp, err := cfg.DB.GetChirp(iChirpID, viewerID(req))
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, err.Error())
+		respondWithAPIError(w, &APIError{Status: http.StatusNotFound, Code: CodeChirpNotFound, Detail: "chirp not found", Cause: err})
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, Chirp{
+	chirps, err := cfg.withAuthors([]Chirp{{
 		ID:       dbChirp.ID,
 		Body:     dbChirp.Body,
 		AuthorId: dbChirp.AuthorId,
-	})
+		MediaIDs: dbChirp.MediaIDs,
+		EditedAt: dbChirp.EditedAt,
+	}})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve author")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirps[0])
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+// handlerChirpsUpdate lets authors whose plan includes editing change the body of their chirps
+func (cfg *apiConfig) handlerChirpsUpdate(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	chirpID := req.PathValue("chirpID")
+	iChirpID, err := strconv.Atoi(chirpID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't parse ID: %v", chirpID))
+		return
+	}
+	user, err := cfg.DB.GetUser(principal.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+	entitlements := cfg.Entitlements.For(user)
+	if !cfg.Entitlements.Require(w, entitlements, CapEditChirps, "editing chirps") {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	existing, err := cfg.DB.GetChirp(iChirpID, user.ID)
+	if err != nil {
+		respondWithChirpError(w, err, "Couldn't retrieve chirp")
+		return
+	}
+	errs := fieldErrors{}
+	cleaned := cfg.validateChirp(w, &errs, entitlements, params.Body, len(existing.MediaIDs) > 0)
+	if !errs.ok(w) {
+		return
+	}
+
+	chirp, err := cfg.DB.EditChirp(iChirpID, user.ID, cleaned)
+	if errors.Is(err, ErrBlocked) {
+		respondWithAPIError(w, newAPIError(http.StatusForbidden, CodeBlocked, "can't mention a user who blocked you"))
+		return
+	}
+	if err != nil {
+		respondWithChirpError(w, err, "Couldn't edit chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Chirp{
+		ID:       chirp.ID,
+		Body:     chirp.Body,
+		AuthorId: chirp.AuthorId,
+		MediaIDs: chirp.MediaIDs,
+		EditedAt: chirp.EditedAt,
+		Author: &AuthorSummary{
+			ID:          user.ID,
+			Handle:      user.Handle,
+			DisplayName: user.DisplayName,
+		},
+	})
+}
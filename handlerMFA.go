@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const MFADuration = 5 * 60
+const TOTPIssuer = "Chirpy"
+const recoveryCodeCount = 10
+
+func (cfg *apiConfig) handlerMFAEnroll(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	user, err := cfg.DB.GetUser(principal.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = cfg.DB.BeginTOTP(user.ID, secret)
+	if errors.Is(err, ErrMFAEnabled) {
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeMFAEnabled, err.Error()))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start enrollment")
+		return
+	}
+
+	type response struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(secret, TOTPIssuer, user.Email),
+	})
+}
+
+func (cfg *apiConfig) handlerMFAConfirm(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.required("code", params.Code)
+	if !errs.ok(w) {
+		return
+	}
+	user, err := cfg.DB.GetUser(principal.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+	if user.TOTP.Enabled() {
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeMFAEnabled, ErrMFAEnabled.Error()))
+		return
+	}
+	if user.TOTP.PendingSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "start enrollment before confirming it")
+		return
+	}
+	step, ok := auth.ValidateTOTP(user.TOTP.PendingSecret, params.Code, time.Now())
+	if !ok {
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidMFACode, ErrInvalidMFACode.Error()))
+		return
+	}
+
+	codes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashToken(code))
+	}
+	err = cfg.DB.ConfirmTOTP(user.ID, step, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication")
+		return
+	}
+
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+func (cfg *apiConfig) handlerMFADisable(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.required("password", params.Password)
+	errs.required("code", params.Code)
+	if !errs.ok(w) {
+		return
+	}
+	user, err := cfg.DB.GetUser(principal.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+	if !user.TOTP.Enabled() {
+		respondWithAPIError(w, newAPIError(http.StatusBadRequest, CodeMFANotEnabled, ErrMFANotEnabled.Error()))
+		return
+	}
+	err = auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidCredentials, "incorrect password"))
+		return
+	}
+	err = cfg.checkSecondFactor(user.ID, "", params.Code)
+	if err != nil {
+		respondWithSecondFactorError(w, err)
+		return
+	}
+
+	err = cfg.DB.DisableTOTP(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerLoginMFA completes a login that handlerUsersLogin answered with an MFA challenge
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.required("mfa_token", params.MFAToken)
+	errs.required("code", params.Code)
+	if !errs.ok(w) {
+		return
+	}
+
+	claims, err := auth.ValidateJWT(params.MFAToken, cfg.Keys, auth.TypeMFA)
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "mfa_token is invalid or expired", Cause: err})
+		return
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "mfa_token is invalid or expired", Cause: err})
+		return
+	}
+	// the request isn't authenticated yet, so it's limited here rather than by requireAuth
+	if !cfg.allowRequest(w, userID) {
+		return
+	}
+	err = cfg.checkSecondFactor(userID, auth.HashToken(claims.ID), params.Code)
+	if err != nil {
+		respondWithSecondFactorError(w, err)
+		return
+	}
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+
+	cfg.respondWithLogin(w, req, user)
+}
+
+// makeMFAToken issues the mfa_token that completes a login with a second
+// factor. Only the last one issued to the user works, and only once
+func (cfg *apiConfig) makeMFAToken(user User) (string, error) {
+	nonce, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	claims := auth.Claims{Type: auth.TypeMFA}
+	claims.ID = nonce
+	token, err := auth.IssueJWT(user.ID, cfg.Keys, time.Duration(MFADuration)*time.Second, claims)
+	if err != nil {
+		return "", err
+	}
+	err = cfg.DB.StartMFAChallenge(user.ID, auth.HashToken(nonce))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// checkSecondFactor accepts a code from the user's authenticator or one of their
+// recovery codes, using it up so it can't be presented again. challengeHash is
+// the hash of the mfa_token's jti when completing a login
+func (cfg *apiConfig) checkSecondFactor(userID int, challengeHash string, code string) error {
+	return cfg.DB.UseSecondFactor(userID, challengeHash, func(totp *TOTPEnrollment) error {
+		if len(code) == auth.TOTPDigits {
+			step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now())
+			if !ok {
+				return ErrInvalidMFACode
+			}
+			return totp.UseStep(step)
+		}
+		return totp.UseRecoveryCode(auth.HashToken(code))
+	})
+}
+
+func respondWithSecondFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrMFANotEnabled):
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidMFACode, ErrInvalidMFACode.Error()))
+	case errors.Is(err, ErrInvalidMFAChallenge):
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidToken, err.Error()))
+	case errors.Is(err, ErrMFALocked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(mfaLockout.Seconds())))
+		respondWithAPIError(w, newAPIError(http.StatusTooManyRequests, CodeMFALocked, err.Error()))
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
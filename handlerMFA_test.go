@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+// enrollTestUser enables two-factor authentication for the user with the
+// given recovery codes
+func enrollTestUser(t *testing.T, db *DB, userID int, recoveryCodes ...string) {
+	t.Helper()
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %v", err)
+	}
+	if err := db.BeginTOTP(userID, secret); err != nil {
+		t.Fatalf("BeginTOTP: %v", err)
+	}
+	hashes := []string{}
+	for _, code := range recoveryCodes {
+		hashes = append(hashes, auth.HashToken(code))
+	}
+	if err := db.ConfirmTOTP(userID, 0, hashes); err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+}
+
+func loginMFA(cfg *apiConfig, mfaToken, code string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"mfa_token": mfaToken, "code": code})
+	req := httptest.NewRequest(http.MethodPost, "/api/login/mfa", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	cfg.handlerLoginMFA(rec, req)
+	return rec
+}
+
+func TestLoginMFATokenIsSingleUse(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	enrollTestUser(t, cfg.DB, user.ID, "recovery-1", "recovery-2", "recovery-3")
+
+	replaced, err := cfg.makeMFAToken(user)
+	if err != nil {
+		t.Fatalf("makeMFAToken: %v", err)
+	}
+	mfaToken, err := cfg.makeMFAToken(user)
+	if err != nil {
+		t.Fatalf("makeMFAToken: %v", err)
+	}
+	if rec := loginMFA(cfg, replaced, "recovery-1"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("replaced mfa_token: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := loginMFA(cfg, mfaToken, "recovery-2"); rec.Code != http.StatusOK {
+		t.Fatalf("first use: got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := loginMFA(cfg, mfaToken, "recovery-3"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("second use: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginMFALocksAfterFailures(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	enrollTestUser(t, cfg.DB, user.ID, "recovery-1")
+	mfaToken, err := cfg.makeMFAToken(user)
+	if err != nil {
+		t.Fatalf("makeMFAToken: %v", err)
+	}
+
+	for i := 0; i < maxMFAFailures; i++ {
+		if rec := loginMFA(cfg, mfaToken, "wrong-code"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("invalid code %d: got %d, want %d", i+1, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	rec := loginMFA(cfg, mfaToken, "recovery-1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("valid code once locked: got %d, want %d: %s", rec.Code, http.StatusTooManyRequests, rec.Body)
+	}
+	if _, err := cfg.makeMFAToken(user); !errors.Is(err, ErrMFALocked) {
+		t.Errorf("new login once locked: got %v, want %v", err, ErrMFALocked)
+	}
+}
+
+func TestUseSecondFactorResetsFailures(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "walt@example.com")
+	enrollTestUser(t, db, user.ID, "recovery-1", "recovery-2")
+	check := func(code string) func(*TOTPEnrollment) error {
+		return func(totp *TOTPEnrollment) error {
+			return totp.UseRecoveryCode(auth.HashToken(code))
+		}
+	}
+
+	for i := 0; i < maxMFAFailures-1; i++ {
+		if err := db.UseSecondFactor(user.ID, "", check("wrong-code")); !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("invalid code: got %v, want %v", err, ErrInvalidMFACode)
+		}
+	}
+	if err := db.UseSecondFactor(user.ID, "", check("recovery-1")); err != nil {
+		t.Fatalf("valid code: %v", err)
+	}
+	if err := db.UseSecondFactor(user.ID, "", check("wrong-code")); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("invalid code after a valid one: got %v, want %v", err, ErrInvalidMFACode)
+	}
+	if err := db.UseSecondFactor(user.ID, "", check("recovery-1")); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("used recovery code: got %v, want %v", err, ErrInvalidMFACode)
+	}
+	if err := db.UseSecondFactor(user.ID, "", check("recovery-2")); err != nil {
+		t.Errorf("valid code: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const maxUploadSize = 5 << 20
+const maxImageDimension = 4096
+const thumbnailSize = 256
+const mediaURLPrefix = "/media/"
+
+// the sniffed content types accepted for upload and the extension they're stored with
+var mediaExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
+type mediaResponse struct {
+	ID           string `json:"id"`
+	ContentType  string `json:"content_type"`
+	Size         int    `json:"size"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+func (cfg *apiConfig) handlerMediaUpload(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	userID := principal.UserID
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "user not found")
+		return
+	}
+	if !user.IsVerified {
+		respondWithAPIError(w, newAPIError(http.StatusForbidden, CodeEmailNotVerified, "email must be verified before uploading media"))
+		return
+	}
+
+	// leave room for the multipart boundaries and headers around the file
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadSize+1<<20)
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "file is too large")
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "expected a multipart form with a file field")
+		return
+	}
+	defer file.Close()
+
+	dat, err := io.ReadAll(io.LimitReader(file, maxUploadSize+1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read file")
+		return
+	}
+	if len(dat) > maxUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "file is too large")
+		return
+	}
+
+	// the client's Content-Type isn't trusted, only what the bytes look like
+	contentType := http.DetectContentType(dat)
+	ext, ok := mediaExtensions[contentType]
+	if !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported media type %s", contentType))
+		return
+	}
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(dat))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode image")
+		return
+	}
+	if imgConfig.Width < 1 || imgConfig.Height < 1 || imgConfig.Width > maxImageDimension || imgConfig.Height > maxImageDimension {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("image dimensions must be between 1 and %d pixels", maxImageDimension))
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(dat))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode image")
+		return
+	}
+	thumb, err := encodeThumbnail(thumbnail(img, thumbnailSize), contentType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	mediaID, err := newMediaID()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	media := Media{
+		ID:           mediaID,
+		OwnerID:      userID,
+		ContentType:  contentType,
+		Size:         len(dat),
+		Width:        imgConfig.Width,
+		Height:       imgConfig.Height,
+		Key:          mediaID + ext,
+		ThumbnailKey: mediaID + "_thumb" + ext,
+		CreatedAt:    time.Now().UTC(),
+	}
+	err = cfg.Blobs.Put(media.Key, bytes.NewReader(dat))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store file")
+		return
+	}
+	err = cfg.Blobs.Put(media.ThumbnailKey, bytes.NewReader(thumb))
+	if err != nil {
+		cfg.Blobs.Delete(media.Key)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store thumbnail")
+		return
+	}
+	stored, err := cfg.DB.CreateMedia(media)
+	if err != nil {
+		cfg.Blobs.Delete(media.Key)
+		cfg.Blobs.Delete(media.ThumbnailKey)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create media")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, newMediaResponse(stored))
+}
+
+func (cfg *apiConfig) handlerMediaGet(w http.ResponseWriter, req *http.Request) {
+	media, err := cfg.DB.GetMedia(req.PathValue("mediaID"))
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusNotFound, Code: CodeMediaNotFound, Detail: "media not found", Cause: err})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newMediaResponse(media))
+}
+
+func newMediaResponse(media Media) mediaResponse {
+	return mediaResponse{
+		ID:           media.ID,
+		ContentType:  media.ContentType,
+		Size:         media.Size,
+		Width:        media.Width,
+		Height:       media.Height,
+		URL:          mediaURL(media.Key),
+		ThumbnailURL: mediaURL(media.ThumbnailKey),
+	}
+}
+
+func mediaURL(key string) string {
+	if key == "" {
+		return ""
+	}
+	return mediaURLPrefix + key
+}
+
+func newMediaID() (string, error) {
+	dat := make([]byte, 16)
+	_, err := rand.Read(dat)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(dat), nil
+}
+
+// thumbnail scales img down with nearest neighbour sampling so its longest side is at most size
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+
+	thumbWidth, thumbHeight := size, size
+	if width > height {
+		thumbHeight = max(1, height*size/width)
+	} else {
+		thumbWidth = max(1, width*size/height)
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		for x := 0; x < thumbWidth; x++ {
+			thumb.Set(x, y, img.At(bounds.Min.X+x*width/thumbWidth, bounds.Min.Y+y*height/thumbHeight))
+		}
+	}
+	return thumb
+}
+
+func encodeThumbnail(img image.Image, contentType string) ([]byte, error) {
+	buf := bytes.Buffer{}
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "image/gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testBlobStore keeps blobs in memory. afterPut, when set, runs after each blob is stored
+type testBlobStore struct {
+	blobs    map[string][]byte
+	afterPut func(key string)
+}
+
+func (bs *testBlobStore) Put(key string, r io.Reader) error {
+	dat, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	bs.blobs[key] = dat
+	if bs.afterPut != nil {
+		bs.afterPut(key)
+	}
+	return nil
+}
+
+func (bs *testBlobStore) Delete(key string) error {
+	delete(bs.blobs, key)
+	return nil
+}
+
+func (bs *testBlobStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	http.NotFound(w, req)
+}
+
+// newUploadTestConfig returns a config storing blobs in memory and a verified
+// user who may upload media
+func newUploadTestConfig(t *testing.T) (*apiConfig, *testBlobStore, User) {
+	t.Helper()
+	cfg, _ := newTestConfig(t)
+	blobs := &testBlobStore{blobs: map[string][]byte{}}
+	cfg.Blobs = blobs
+	user := createVerifiedUser(t, cfg.DB, "walt@example.com")
+	return cfg, blobs, user
+}
+
+func uploadTestFile(t *testing.T, cfg *apiConfig, userID int, name string, dat []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	file.Write(dat)
+	form.Close()
+
+	req := authenticated(httptest.NewRequest(http.MethodPost, "/api/media", body), userID)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	cfg.handlerMediaUpload(rec, req)
+	return rec
+}
+
+func uploadTestImage(t *testing.T, cfg *apiConfig, userID int) *httptest.ResponseRecorder {
+	t.Helper()
+	img := &bytes.Buffer{}
+	if err := png.Encode(img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return uploadTestFile(t, cfg, userID, "avatar.png", img.Bytes())
+}
+
+func TestMediaUpload(t *testing.T) {
+	cfg, blobs, user := newUploadTestConfig(t)
+
+	rec := uploadTestImage(t, cfg, user.ID)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var resp mediaResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("malformed response: %v", err)
+	}
+	if resp.ID == "" || resp.ContentType != "image/png" || resp.Width != 2 || resp.Height != 2 {
+		t.Errorf("response = %+v, want a 2x2 image/png", resp)
+	}
+	media, err := cfg.DB.GetMedia(resp.ID)
+	if err != nil {
+		t.Fatalf("GetMedia: %v", err)
+	}
+	if media.OwnerID != user.ID {
+		t.Errorf("media is owned by %d, want %d", media.OwnerID, user.ID)
+	}
+	if resp.URL != mediaURL(media.Key) || resp.ThumbnailURL != mediaURL(media.ThumbnailKey) {
+		t.Errorf("response URLs = %q and %q, want the stored keys %q and %q", resp.URL, resp.ThumbnailURL, media.Key, media.ThumbnailKey)
+	}
+	for _, key := range []string{media.Key, media.ThumbnailKey} {
+		if _, ok := blobs.blobs[key]; !ok {
+			t.Errorf("blob %q wasn't stored", key)
+		}
+	}
+}
+
+func TestMediaUploadRejectsUnsupportedFiles(t *testing.T) {
+	cfg, blobs, user := newUploadTestConfig(t)
+
+	// the bytes decide the type, not the name
+	rec := uploadTestFile(t, cfg, user.ID, "avatar.png", []byte("say my name"))
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got %d, want %d: %s", rec.Code, http.StatusUnsupportedMediaType, rec.Body)
+	}
+	if len(blobs.blobs) != 0 {
+		t.Errorf("stored %d blobs for a rejected upload, want 0", len(blobs.blobs))
+	}
+}
+
+func TestMediaUploadRequiresVerifiedEmail(t *testing.T) {
+	cfg, blobs, _ := newUploadTestConfig(t)
+	user := createTestUser(t, cfg.DB, "jesse@example.com")
+
+	rec := uploadTestImage(t, cfg, user.ID)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+	if len(blobs.blobs) != 0 {
+		t.Errorf("stored %d blobs for a rejected upload, want 0", len(blobs.blobs))
+	}
+}
+
+func TestMediaUploadRemovesBlobsWhenNotSaved(t *testing.T) {
+	cfg, blobs, user := newUploadTestConfig(t)
+	// once both blobs are stored, make the database unreadable so saving the media fails
+	blobs.afterPut = func(key string) {
+		if !strings.Contains(key, "_thumb") {
+			return
+		}
+		if err := os.Remove(cfg.DB.path); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		if err := os.Mkdir(cfg.DB.path, 0700); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+
+	rec := uploadTestImage(t, cfg, user.ID)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusInternalServerError, rec.Body)
+	}
+	if len(blobs.blobs) != 0 {
+		t.Errorf("%d blobs were left behind by a failed upload, want 0", len(blobs.blobs))
+	}
+}
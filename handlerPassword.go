@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const ResetDuration = 60 * 60
+
+func (cfg *apiConfig) handlerPasswordForgot(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.email("email", params.Email)
+	if !errs.ok(w) {
+		return
+	}
+
+	// Always respond the same way so the endpoint can't be used to find registered emails
+	user, err := cfg.DB.FindUserByEmail(params.Email)
+	if err != nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	token, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	expiresAt := time.Now().UTC().Add(time.Duration(ResetDuration) * time.Second)
+	err = cfg.DB.CreatePasswordReset(user.ID, auth.HashToken(token), expiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create reset token")
+		return
+	}
+
+	body := fmt.Sprintf("Someone asked to reset your Chirpy password. If it wasn't you, ignore this email.\n\nTo choose a new password send this token to POST /api/password/reset within an hour:\n\n%s\n", token)
+	err = cfg.Mailer.Send(user.Email, "Reset your Chirpy password", body)
+	if err != nil {
+		log.Printf("Couldn't send reset email to user %v: %s", user.ID, err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerPasswordReset(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.required("token", params.Token)
+	if !errs.ok(w) {
+		return
+	}
+
+	user, err := cfg.DB.FindPasswordReset(auth.HashToken(params.Token))
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "invalid or expired reset token", Cause: err})
+		return
+	}
+	errs.password(cfg.PasswordPolicy, "password", params.Password, user.Email)
+	if !errs.ok(w) {
+		return
+	}
+	hashedPwd, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the token may have been used while the password was hashed, ResetPassword checks it again
+	_, err = cfg.DB.ResetPassword(auth.HashToken(params.Token), hashedPwd)
+	if errors.Is(err, ErrInvalidResetToken) {
+		respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "invalid or expired reset token", Cause: err})
+		return
+	}
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Detail: "couldn't reset password", Cause: err})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,48 +1,236 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/janmmiranda/chripy/internal/auth"
 )
 
 const USER_UPGRADED = "user.upgraded"
-const APIKEY = "ApiKey"
+const USER_RENEWED = "user.renewed"
+const USER_PAYMENT_FAILED = "user.payment_failed"
+const USER_CANCELED = "user.canceled"
+const USER_DOWNGRADED = "user.downgraded"
+const polkaSignatureHeader = "Polka-Signature"
+const polkaSignatureTolerance = 5 * time.Minute
+
+type polkaRequest struct {
+	// ID identifies the event across retried deliveries. Events without one are
+	// identified by their body
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserId int    `json:"user_id"`
+		Plan   string `json:"plan"`
+		// ExpiresAt is the end of the period paid for, when Polka knows it
+		ExpiresAt *time.Time `json:"expires_at"`
+	} `json:"data"`
+}
 
 func (cfg *apiConfig) handlerPolkaWebhooks(w http.ResponseWriter, req *http.Request) {
-	type data struct {
-		UserId int `json:"user_id"`
-	}
-	type polkaRequest struct {
-		Event string `json:"event"`
-		Data  data   `json:"data"`
+	body, ok := cfg.verifyPolkaSignature(w, req)
+	if !ok {
+		return
 	}
 
-	apiToken, err := auth.GetBearerToken(req.Header, APIKEY)
-	if err != nil || apiToken != cfg.PolkaKey {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	params := polkaRequest{}
+	if !decodeLenientJSON(w, req, &params) {
 		return
 	}
+	errs := fieldErrors{}
+	errs.required("event", params.Event)
+	errs.maxLength("id", params.ID, 255)
+	if !errs.ok(w) {
+		return
+	}
+	id := params.ID
+	if id == "" {
+		id = "sha256:" + auth.HashToken(string(body))
+	}
 
-	decoder := json.NewDecoder(req.Body)
-	params := polkaRequest{}
-	err = decoder.Decode(&params)
+	owner, err := newRandomID()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record event")
 		return
 	}
-	event := params.Event
-	if event != USER_UPGRADED {
+	event, err := cfg.DB.RecordPolkaEvent(PolkaEvent{
+		ID:      id,
+		Type:    params.Event,
+		Payload: body,
+	}, owner)
+	// a retried delivery of an event that was already handled is only acknowledged
+	if errors.Is(err, ErrPolkaEventDone) {
 		respondWithJSON(w, http.StatusOK, response{})
 		return
 	}
+	// Polka retries the delivery later, once the one processing it has finished
+	if errors.Is(err, ErrPolkaEventClaimed) {
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeEventInProgress, err.Error()))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record event")
+		return
+	}
 
-	userId := params.Data.UserId
-	upgraded, err := cfg.DB.UpgradeUser(userId)
-	if err != nil || !upgraded {
-		respondWithError(w, http.StatusNotFound, "user not found")
+	status, processErr := cfg.processPolkaEvent(event)
+	_, err = cfg.DB.FinishPolkaEvent(event.ID, owner, status, processErr)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record event")
+		return
+	}
+	if errors.Is(processErr, ErrUserNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	if errors.Is(processErr, ErrNoSubscription) || errors.Is(processErr, ErrUnknownPlan) {
+		respondWithAPIError(w, newAPIError(http.StatusUnprocessableEntity, CodeInvalidEvent, processErr.Error()))
+		return
+	}
+	if processErr != nil {
+		respondWithError(w, http.StatusInternalServerError, processErr.Error())
 		return
 	}
 	respondWithJSON(w, http.StatusOK, response{})
 }
+
+// processPolkaEvent applies a recorded event to the user's subscription and
+// returns the status to record. Events about anything else are ignored
+func (cfg *apiConfig) processPolkaEvent(event PolkaEvent) (string, error) {
+	params := polkaRequest{}
+	err := json.Unmarshal(event.Payload, &params)
+	if err != nil {
+		return PolkaFailed, err
+	}
+	userID := params.Data.UserId
+	change := SubscriptionChange{
+		Plan:      params.Data.Plan,
+		ExpiresAt: params.Data.ExpiresAt,
+	}
+
+	switch event.Type {
+	case USER_UPGRADED:
+		_, err = cfg.DB.StartSubscription(userID, change, cfg.SubscriptionTerms)
+	case USER_RENEWED:
+		_, err = cfg.DB.RenewSubscription(userID, change, cfg.SubscriptionTerms)
+	case USER_PAYMENT_FAILED:
+		_, err = cfg.DB.FailSubscriptionPayment(userID, cfg.SubscriptionTerms)
+	case USER_CANCELED:
+		_, err = cfg.DB.CancelSubscription(userID)
+	case USER_DOWNGRADED:
+		_, err = cfg.DB.EndSubscription(userID)
+	default:
+		return PolkaIgnored, nil
+	}
+	if err != nil {
+		return PolkaFailed, err
+	}
+	return PolkaProcessed, nil
+}
+
+// verifyPolkaSignature checks the request body was signed by Polka in the last
+// few minutes and hasn't been seen before, responding with 401 when it wasn't.
+// It returns the body, which is also put back for decodeLenientJSON
+func (cfg *apiConfig) verifyPolkaSignature(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	// refused with a server error so Polka keeps retrying until the keys are set
+	if len(cfg.PolkaKeys) == 0 {
+		respondWithError(w, http.StatusServiceUnavailable, "Polka webhooks aren't configured")
+		return nil, false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestBodySize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+		return nil, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read request body")
+		return nil, false
+	}
+
+	now := time.Now()
+	signedAt, err := auth.VerifySignature(req.Header.Get(polkaSignatureHeader), body, cfg.PolkaKeys, now, polkaSignatureTolerance)
+	if err == nil {
+		// the same body signed at the same time is a replay, however the header is written
+		err = cfg.PolkaReplays.Check(strconv.FormatInt(signedAt.Unix(), 10)+"."+auth.HashToken(string(body)), now)
+	}
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidSignature, err.Error()))
+		return nil, false
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// handlerAdminPolkaEventsGet returns the Polka events received, newest first,
+// optionally only those with the given status
+func (cfg *apiConfig) handlerAdminPolkaEventsGet(w http.ResponseWriter, req *http.Request) {
+	status := req.URL.Query().Get("status")
+	if status != "" && status != PolkaReceived && status != PolkaProcessing && status != PolkaProcessed && status != PolkaIgnored && status != PolkaFailed {
+		respondWithError(w, http.StatusBadRequest, "status must be received, processing, processed, ignored or failed")
+		return
+	}
+	events, err := cfg.DB.GetPolkaEvents(status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve events")
+		return
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ReceivedAt.After(events[j].ReceivedAt)
+	})
+	respondWithJSON(w, http.StatusOK, events)
+}
+
+// handlerAdminPolkaEventReplay processes an event that failed or was never
+// finished again, and responds with its new status. Events being processed
+// can't be replayed until their claim times out
+func (cfg *apiConfig) handlerAdminPolkaEventReplay(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	owner, err := newRandomID()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't claim event")
+		return
+	}
+	event, err := cfg.DB.ClaimPolkaEvent(req.PathValue("eventID"), owner)
+	if errors.Is(err, ErrNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeEventNotFound, "event not found"))
+		return
+	}
+	if errors.Is(err, ErrPolkaEventDone) {
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeEventProcessed, "event was already "+event.Status))
+		return
+	}
+	if errors.Is(err, ErrPolkaEventClaimed) {
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeEventInProgress, err.Error()))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't claim event")
+		return
+	}
+
+	status, processErr := cfg.processPolkaEvent(event)
+	event, err = cfg.DB.FinishPolkaEvent(event.ID, owner, status, processErr)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record event")
+		return
+	}
+	err = cfg.DB.RecordAudit(principal.UserID, "polka.replayed", 0, event.ID+" "+event.Status)
+	if err != nil {
+		log.Printf("Couldn't record replay of Polka event %s in the audit log: %s", event.ID, err)
+	}
+	respondWithJSON(w, http.StatusOK, event)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const testPolkaKey = "polka-secret"
+
+func newPolkaTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	cfg, _ := newTestConfig(t)
+	cfg.PolkaKeys = []string{testPolkaKey}
+	cfg.PolkaReplays = auth.NewReplayCache(2 * polkaSignatureTolerance)
+	cfg.SubscriptionTerms = SubscriptionTerms{Period: time.Hour}
+	return cfg
+}
+
+func upgradeEvent(eventID string, userID int) []byte {
+	return []byte(fmt.Sprintf(`{"id": %q, "event": %q, "data": {"user_id": %d}}`, eventID, USER_UPGRADED, userID))
+}
+
+func sendPolkaWebhook(cfg *apiConfig, body []byte, signature string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", bytes.NewReader(body))
+	if signature != "" {
+		req.Header.Set(polkaSignatureHeader, signature)
+	}
+	rec := httptest.NewRecorder()
+	cfg.handlerPolkaWebhooks(rec, req)
+	return rec
+}
+
+func TestPolkaWebhooksRejectBadSignatures(t *testing.T) {
+	body := upgradeEvent("evt_1", 1)
+	now := time.Now()
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+	}{
+		{name: "unsigned", body: body, signature: ""},
+		{name: "malformed", body: body, signature: "v1"},
+		{name: "wrong secret", body: body, signature: auth.SignPayload("not-polka", now, body)},
+		{name: "tampered body", body: upgradeEvent("evt_1", 2), signature: auth.SignPayload(testPolkaKey, now, body)},
+		{name: "too old", body: body, signature: auth.SignPayload(testPolkaKey, now.Add(-2*polkaSignatureTolerance), body)},
+		{name: "from the future", body: body, signature: auth.SignPayload(testPolkaKey, now.Add(2*polkaSignatureTolerance), body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newPolkaTestConfig(t)
+			user := createTestUser(t, cfg.DB, "walt@example.com")
+
+			rec := sendPolkaWebhook(cfg, tt.body, tt.signature)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+			}
+			if problem := decodeProblem(t, rec); problem.Code != CodeInvalidSignature {
+				t.Errorf("code = %q, want %q", problem.Code, CodeInvalidSignature)
+			}
+			if events, _ := cfg.DB.GetPolkaEvents(""); len(events) != 0 {
+				t.Errorf("recorded %d events from an unverified webhook, want 0", len(events))
+			}
+			if user, _ := cfg.DB.GetUser(user.ID); user.IsChirpyRed() {
+				t.Error("an unverified webhook upgraded the user")
+			}
+		})
+	}
+}
+
+func TestPolkaWebhooksAcceptEveryKey(t *testing.T) {
+	cfg := newPolkaTestConfig(t)
+	cfg.PolkaKeys = []string{"new-secret", testPolkaKey}
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+
+	body := upgradeEvent("evt_1", user.ID)
+	rec := sendPolkaWebhook(cfg, body, auth.SignPayload(testPolkaKey, time.Now(), body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("webhook signed with the old secret: got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if user, _ := cfg.DB.GetUser(user.ID); !user.IsChirpyRed() {
+		t.Error("the user wasn't upgraded")
+	}
+}
+
+func TestPolkaWebhooksRejectReplays(t *testing.T) {
+	cfg := newPolkaTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	body := upgradeEvent("evt_1", user.ID)
+	signedAt := time.Now()
+	signature := auth.SignPayload(testPolkaKey, signedAt, body)
+
+	rec := sendPolkaWebhook(cfg, body, signature)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if user, _ := cfg.DB.GetUser(user.ID); !user.IsChirpyRed() {
+		t.Fatal("the user wasn't upgraded")
+	}
+
+	// the same signed request, however the header is written
+	timestamp, mac, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	for _, replayed := range []string{signature, mac + ",t=" + timestamp, "t=" + timestamp + ", " + mac} {
+		rec := sendPolkaWebhook(cfg, body, replayed)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("replay with %q: got %d, want %d: %s", replayed, rec.Code, http.StatusUnauthorized, rec.Body)
+			continue
+		}
+		if problem := decodeProblem(t, rec); problem.Code != CodeInvalidSignature {
+			t.Errorf("replay with %q: code = %q, want %q", replayed, problem.Code, CodeInvalidSignature)
+		}
+	}
+	events, err := cfg.DB.GetPolkaEvents("")
+	if err != nil {
+		t.Fatalf("GetPolkaEvents: %v", err)
+	}
+	if len(events) != 1 || events[0].Status != PolkaProcessed {
+		t.Errorf("events = %+v, want the one processed event", events)
+	}
+}
+
+func TestPolkaWebhooksAcknowledgeRetriedEvents(t *testing.T) {
+	cfg := newPolkaTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	body := upgradeEvent("evt_1", user.ID)
+	signedAt := time.Now()
+
+	for _, at := range []time.Time{signedAt, signedAt.Add(time.Second)} {
+		rec := sendPolkaWebhook(cfg, body, auth.SignPayload(testPolkaKey, at, body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+		}
+	}
+	events, err := cfg.DB.GetPolkaEvents("")
+	if err != nil {
+		t.Fatalf("GetPolkaEvents: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "evt_1" {
+		t.Errorf("events = %+v, want evt_1 once", events)
+	}
+	var payload polkaRequest
+	if err := json.Unmarshal(events[0].Payload, &payload); err != nil || payload.Data.UserId != user.ID {
+		t.Errorf("recorded payload %s, want the delivered body", events[0].Payload)
+	}
+}
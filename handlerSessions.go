@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+func (cfg *apiConfig) handlerSessionsGet(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	sessions, err := cfg.DB.GetSessions(principal.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve sessions")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (cfg *apiConfig) handlerSessionsDelete(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	err := cfg.DB.RevokeSession(principal.UserID, req.PathValue("sessionID"))
+	if errors.Is(err, ErrNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeSessionNotFound, "session not found"))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerSessionsDeleteAll logs the user out everywhere
+func (cfg *apiConfig) handlerSessionsDeleteAll(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	err := cfg.DB.RevokeSessions(principal.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startSession records a login from req and returns its ID and first refresh token
+func (cfg *apiConfig) startSession(userID int, req *http.Request) (string, string, error) {
+	refreshToken, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	sessionID, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	expiresAt := time.Now().UTC().Add(cfg.RefreshDuration)
+	session, err := cfg.DB.CreateSession(Session{
+		ID:        sessionID[:16],
+		UserID:    userID,
+		UserAgent: req.UserAgent(),
+		IP:        clientIP(req),
+	}, auth.HashToken(refreshToken), expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+	return session.ID, refreshToken, nil
+}
+
+// makeAccessToken issues an access token for the user's session. It stops
+// working as soon as the session is revoked
+func (cfg *apiConfig) makeAccessToken(user User, sessionID string) (string, error) {
+	return auth.IssueJWT(user.ID, cfg.Keys, cfg.AccessDuration, auth.Claims{
+		Type:      auth.TypeAccess,
+		Role:      user.RoleOrDefault(),
+		SessionID: sessionID,
+	})
+}
+
+// clientIP returns the address the request came from. Forwarding headers are
+// ignored since they can be set by anyone
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+func (cfg *apiConfig) handlerUsersBlock(w http.ResponseWriter, req *http.Request) {
+	cfg.handleRelation(w, req, cfg.DB.BlockUser)
+}
+
+func (cfg *apiConfig) handlerUsersUnblock(w http.ResponseWriter, req *http.Request) {
+	cfg.handleRelation(w, req, cfg.DB.UnblockUser)
+}
+
+func (cfg *apiConfig) handlerUsersMute(w http.ResponseWriter, req *http.Request) {
+	cfg.handleRelation(w, req, cfg.DB.MuteUser)
+}
+
+func (cfg *apiConfig) handlerUsersUnmute(w http.ResponseWriter, req *http.Request) {
+	cfg.handleRelation(w, req, cfg.DB.UnmuteUser)
+}
+
+// handleRelation applies update between the authenticated user and the user in the path
+func (cfg *apiConfig) handleRelation(w http.ResponseWriter, req *http.Request, update func(userID, targetID int) error) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	userID := principal.UserID
+	targetID, err := strconv.Atoi(req.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse user ID")
+		return
+	}
+	if targetID == userID {
+		respondWithError(w, http.StatusBadRequest, "users can't block or mute themselves")
+		return
+	}
+
+	err = update(userID, targetID)
+	if errors.Is(err, ErrUserNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// viewerID returns the id of the user making the request, or 0 for anonymous requests
+func viewerID(req *http.Request) int {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		return 0
+	}
+	return principal.UserID
+}
@@ -1,39 +1,45 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/janmmiranda/chripy/internal/auth"
 )
 
-const AccessIssuer = "chirpy-access"
-const RefreshIssuer = "chirpy-refresh"
-const AccessDuration = 60 * 60
-const RefreshDuration = 60 * 60 * 24 * 60
 const BEARER = "Bearer"
 
 type parameters struct {
-	Email    string `json:"email`
-	Password string `json:"password`
+	Email    string `json:"email"`
+	Password string `json:"password"`
 }
 
 type response struct {
 	ID           int    `json:"id"`
 	Email        string `json:"email"`
 	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	IsVerified   bool   `json:"is_verified"`
+	Handle       string `json:"handle,omitempty"`
+	DisplayName  string `json:"display_name,omitempty"`
+	Bio          string `json:"bio,omitempty"`
+	AvatarURL    string `json:"avatar_url,omitempty"`
 	Token        string `json:"token"`
 	RefreshToken string `json:"refresh_token"`
+	MFARequired  bool   `json:"mfa_required,omitempty"`
+	MFAToken     string `json:"mfa_token,omitempty"`
 }
 
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, req *http.Request) {
-	decoder := json.NewDecoder(req.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.email("email", params.Email)
+	errs.password(cfg.PasswordPolicy, "password", params.Password, params.Email)
+	if !errs.ok(w) {
 		return
 	}
 
@@ -44,103 +50,217 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, req *http.Reques
 	}
 
 	user, err := cfg.DB.CreateUser(params.Email, hashedPwd)
+	if errors.Is(err, ErrEmailTaken) {
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeEmailTaken, "email is already in use"))
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
 		return
 	}
+	err = cfg.sendVerificationEmail(user, 0)
+	if err != nil {
+		log.Printf("Couldn't send verification email to user %v: %s", user.ID, err)
+	}
 	respondWithJSON(w, http.StatusCreated, response{
 		ID:          user.ID,
 		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
+		IsChirpyRed: user.IsChirpyRed(),
+		IsVerified:  user.IsVerified,
 	})
 }
 
 func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, req *http.Request) {
-	decoder := json.NewDecoder(req.Body)
-	bearerToken, err := auth.GetBearerToken(req.Header, BEARER)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
+	type parameters struct {
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		Handle          *string `json:"handle"`
+		DisplayName     *string `json:"display_name"`
+		Bio             *string `json:"bio"`
+		AvatarMediaID   *string `json:"avatar_media_id"`
 	}
-	userIDString, issuer, err := auth.ValidateJWT(bearerToken, cfg.JWTSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
 		return
 	}
-	if issuer == RefreshIssuer {
-		respondWithError(w, http.StatusUnauthorized, "refresh token not accepted for updates")
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
 		return
 	}
-	params := parameters{}
-	err = decoder.Decode(&params)
+
+	userId := principal.UserID
+	current, err := cfg.DB.GetUser(userId)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
 		return
 	}
-
-	userId, errr := strconv.Atoi(userIDString)
-	if errr != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+	handle, displayName, bio := current.Handle, current.DisplayName, current.Bio
+	if params.Handle != nil {
+		handle = *params.Handle
+	}
+	if params.DisplayName != nil {
+		displayName = *params.DisplayName
+	}
+	if params.Bio != nil {
+		bio = *params.Bio
+	}
+	email := current.Email
+	errs := fieldErrors{}
+	if params.Email != nil {
+		email = *params.Email
+		errs.email("email", email)
+	}
+	if params.Password != nil {
+		errs.password(cfg.PasswordPolicy, "password", *params.Password, email)
+	}
+	handle = validateProfile(&errs, handle, displayName, bio)
+	if !errs.ok(w) {
 		return
 	}
 
-	hashedPwd, err := auth.HashPassword(params.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	changes := UserChanges{
+		DisplayName:   params.DisplayName,
+		Bio:           params.Bio,
+		AvatarMediaID: params.AvatarMediaID,
+	}
+	if params.Handle != nil {
+		changes.Handle = &handle
+	}
+	if params.Email != nil || params.Password != nil {
+		err = auth.CheckPasswordHash(params.CurrentPassword, current.Password)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "current_password is incorrect")
+			return
+		}
+		changes.Email = &email
+		if params.Password != nil {
+			hashedPwd, err := auth.HashPassword(*params.Password)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			changes.PasswordHash = &hashedPwd
+		}
 	}
 
-	user, err := cfg.DB.UpdateUser(userId, params.Email, hashedPwd)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
+	// every change is made in one write, so a conflict leaves the user as they were
+	user, err := cfg.DB.ChangeUser(userId, changes)
+	switch {
+	case errors.Is(err, ErrEmailTaken):
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeEmailTaken, "email is already in use"))
+		return
+	case errors.Is(err, ErrHandleTaken):
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeHandleTaken, "handle is already in use"))
+		return
+	case errors.Is(err, ErrInvalidMedia):
+		respondWithAPIError(w, newAPIError(http.StatusBadRequest, CodeMediaNotFound, "avatar media not found"))
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
 		return
 	}
+	if user.Email != current.Email {
+		err = cfg.sendVerificationEmail(user, 0)
+		if err != nil {
+			log.Printf("Couldn't send verification email to user %v: %s", user.ID, err)
+		}
+	}
+
 	respondWithJSON(w, http.StatusOK, response{
-		ID:    user.ID,
-		Email: user.Email,
+		ID:          user.ID,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed(),
+		IsVerified:  user.IsVerified,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   mediaURL(user.Avatar),
 	})
 }
 
 func (cfg *apiConfig) handlerUsersLogin(w http.ResponseWriter, req *http.Request) {
 	type params struct {
-		Email            string `json:"email`
+		Email            string `json:"email"`
 		Password         string `json:"password"`
 		ExpiresInSeconds int    `json:"expires_in_seconds"`
 	}
 
-	decoder := json.NewDecoder(req.Body)
 	p := params{}
-	err := decoder.Decode(&p)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+	if !decodeJSON(w, req, &p) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.required("email", p.Email)
+	errs.required("password", p.Password)
+	if !errs.ok(w) {
 		return
 	}
 
+	// unknown emails and wrong passwords get the same response so it can't be used to find accounts
 	user, err := cfg.DB.FindUserByEmail(p.Email)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidCredentials, "incorrect email or password"))
 		return
 	}
 	err = auth.CheckPasswordHash(p.Password, user.Password)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidCredentials, "incorrect email or password"))
+		return
+	}
+	// the password is only known now, so this is when older hashes can be upgraded
+	if auth.NeedsRehash(user.Password) {
+		hashedPwd, err := auth.HashPassword(p.Password)
+		if err == nil {
+			err = cfg.DB.RehashPassword(user.ID, user.Password, hashedPwd)
+		}
+		if err != nil {
+			log.Printf("Couldn't rehash password for user %d: %s", user.ID, err)
+		}
+	}
+
+	if user.TOTP.Enabled() {
+		mfaToken, err := cfg.makeMFAToken(user)
+		if errors.Is(err, ErrMFALocked) {
+			respondWithSecondFactorError(w, err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, response{
+			ID:          user.ID,
+			Email:       user.Email,
+			IsChirpyRed: user.IsChirpyRed(),
+			IsVerified:  user.IsVerified,
+			MFARequired: true,
+			MFAToken:    mfaToken,
+		})
 		return
 	}
+	cfg.respondWithLogin(w, req, user)
+}
 
-	accessToken, err := auth.MakeJWT(user.ID, cfg.JWTSecret, time.Duration(AccessDuration)*time.Second, AccessIssuer)
+// respondWithLogin starts a session for a user who has passed every login check
+func (cfg *apiConfig) respondWithLogin(w http.ResponseWriter, req *http.Request, user User) {
+	sessionID, refreshToken, err := cfg.startSession(user.ID, req)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
 		return
 	}
-	refreshToken, err := auth.MakeJWT(user.ID, cfg.JWTSecret, time.Duration(RefreshDuration)*time.Second, RefreshIssuer)
+	accessToken, err := cfg.makeAccessToken(user, sessionID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	respondWithJSON(w, http.StatusOK, response{
 		ID:           user.ID,
 		Email:        user.Email,
-		IsChirpyRed:  user.IsChirpyRed,
+		IsChirpyRed:  user.IsChirpyRed(),
+		IsVerified:   user.IsVerified,
 		Token:        accessToken,
 		RefreshToken: refreshToken,
 	})
@@ -152,35 +272,43 @@ func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, req *http.Reque
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	userIDString, issuer, err := auth.ValidateJWT(bearerToken, cfg.JWTSecret)
+	refreshToken, err := auth.MakeOpaqueToken()
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if issuer != RefreshIssuer {
-		respondWithError(w, http.StatusUnauthorized, "access token not accepted for refresh")
+	expiresAt := time.Now().UTC().Add(cfg.RefreshDuration)
+	stored, err := cfg.DB.RotateRefreshToken(auth.HashToken(bearerToken), auth.HashToken(refreshToken), clientIP(req), expiresAt)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeRefreshTokenReused, err.Error()))
 		return
 	}
-	isRevoked, err := cfg.DB.CheckRefreshToken(bearerToken)
-	if err != nil || isRevoked {
-		respondWithError(w, http.StatusUnauthorized, "refresh token is revoked")
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidToken, err.Error()))
 		return
 	}
-	type response struct {
-		Token string `json:"token"`
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't refresh token")
+		return
 	}
-	userID, err := strconv.Atoi(userIDString)
+	// the role is read again so role changes apply to new access tokens
+	user, err := cfg.DB.GetUser(stored.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusUnauthorized, "user not found")
 		return
 	}
-	tokenStr, err := auth.MakeJWT(userID, cfg.JWTSecret, time.Hour, AccessIssuer)
+	type response struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	tokenStr, err := cfg.makeAccessToken(user, stored.FamilyID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	respondWithJSON(w, http.StatusOK, response{
-		Token: tokenStr,
+		Token:        tokenStr,
+		RefreshToken: refreshToken,
 	})
 }
 
@@ -190,16 +318,11 @@ func (cfg *apiConfig) handlerRevokeToken(w http.ResponseWriter, req *http.Reques
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	_, issuer, err := auth.ValidateJWT(bearerToken, cfg.JWTSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-	if issuer != RefreshIssuer {
-		respondWithError(w, http.StatusUnauthorized, "access token not accepted for refresh")
+	err = cfg.DB.RevokeRefreshToken(auth.HashToken(bearerToken))
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		respondWithAPIError(w, newAPIError(http.StatusUnauthorized, CodeInvalidToken, err.Error()))
 		return
 	}
-	err = cfg.DB.RevokeRefreshToken(bearerToken)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
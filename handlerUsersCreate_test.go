@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+// createTestUserWithPassword creates a user who can confirm changes with pwd
+func createTestUserWithPassword(t *testing.T, db *DB, email string, pwd string) User {
+	t.Helper()
+	hash, err := auth.HashPassword(pwd)
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	user, err := db.CreateUser(email, hash)
+	if err != nil {
+		t.Fatalf("CreateUser(%q): %v", email, err)
+	}
+	return user
+}
+
+func updateUser(cfg *apiConfig, userID int, fields map[string]string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(fields)
+	req := authenticated(httptest.NewRequest(http.MethodPatch, "/api/users", bytes.NewReader(body)), userID)
+	rec := httptest.NewRecorder()
+	cfg.handlerUsersUpdate(rec, req)
+	return rec
+}
+
+func TestUsersUpdateLeavesOmittedFields(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUserWithPassword(t, cfg.DB, "walt@example.com", "say-my-name-2008")
+
+	// profile fields don't need the current password
+	rec := updateUser(cfg, user.ID, map[string]string{"display_name": "Heisenberg"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	updated, err := cfg.DB.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if updated.DisplayName != "Heisenberg" {
+		t.Errorf("display name = %q, want %q", updated.DisplayName, "Heisenberg")
+	}
+	if updated.Email != user.Email || updated.Password != user.Password {
+		t.Error("the email or password changed when only the display name was sent")
+	}
+}
+
+func TestUsersUpdateNeedsCurrentPassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+	}{
+		{
+			name:   "email without current password",
+			fields: map[string]string{"email": "heisenberg@example.com"},
+		},
+		{
+			name:   "password without current password",
+			fields: map[string]string{"password": "blue-sky-99.1"},
+		},
+		{
+			name:   "password with wrong current password",
+			fields: map[string]string{"password": "blue-sky-99.1", "current_password": "los-pollos"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			user := createTestUserWithPassword(t, cfg.DB, "walt@example.com", "say-my-name-2008")
+
+			rec := updateUser(cfg, user.ID, tt.fields)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+			}
+			updated, err := cfg.DB.GetUser(user.ID)
+			if err != nil {
+				t.Fatalf("GetUser: %v", err)
+			}
+			if updated.Email != user.Email || updated.Password != user.Password {
+				t.Error("the user changed without the current password")
+			}
+		})
+	}
+}
+
+func TestUsersUpdatePasswordKeepsEmail(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUserWithPassword(t, cfg.DB, "walt@example.com", "say-my-name-2008")
+
+	rec := updateUser(cfg, user.ID, map[string]string{
+		"password":         "blue-sky-99.1",
+		"current_password": "say-my-name-2008",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	updated, err := cfg.DB.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if updated.Email != user.Email {
+		t.Errorf("email = %q, want it left as %q", updated.Email, user.Email)
+	}
+	if err := auth.CheckPasswordHash("blue-sky-99.1", updated.Password); err != nil {
+		t.Errorf("the new password doesn't match: %v", err)
+	}
+	if len(mailer.bodies) != 0 {
+		t.Errorf("sent %d emails when the email didn't change, want 0", len(mailer.bodies))
+	}
+}
+
+func TestUsersUpdateEmailNeedsVerifying(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUserWithPassword(t, cfg.DB, "walt@example.com", "say-my-name-2008")
+	if err := cfg.sendVerificationEmail(user, 0); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	if rec := verify(cfg, mailer.lastToken(t)); rec.Code != http.StatusOK {
+		t.Fatalf("verify: got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	rec := updateUser(cfg, user.ID, map[string]string{
+		"email":            "heisenberg@example.com",
+		"current_password": "say-my-name-2008",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	updated, err := cfg.DB.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if updated.Email != "heisenberg@example.com" || updated.IsVerified {
+		t.Errorf("user = %q verified %v, want the new email unverified", updated.Email, updated.IsVerified)
+	}
+	if updated.Password != user.Password {
+		t.Error("the password changed when only the email was sent")
+	}
+	if len(mailer.bodies) != 2 {
+		t.Errorf("sent %d emails, want a verification email for the new address", len(mailer.bodies))
+	}
+}
+
+func TestUsersUpdateConflictChangesNothing(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUserWithPassword(t, cfg.DB, "walt@example.com", "say-my-name-2008")
+	other := createTestUser(t, cfg.DB, "jesse@example.com")
+	taken := "capncook"
+	if _, err := cfg.DB.ChangeUser(other.ID, UserChanges{Handle: &taken}); err != nil {
+		t.Fatalf("ChangeUser: %v", err)
+	}
+
+	rec := updateUser(cfg, user.ID, map[string]string{
+		"email":            "heisenberg@example.com",
+		"current_password": "say-my-name-2008",
+		"handle":           "CapnCook",
+	})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	user, err := cfg.DB.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.Email != "walt@example.com" {
+		t.Errorf("email was changed to %q by a rejected update", user.Email)
+	}
+	if len(mailer.bodies) != 0 {
+		t.Errorf("sent %d emails for a rejected update, want 0", len(mailer.bodies))
+	}
+}
+
+func TestUsersCreateRejectsPasswordsAgainstPolicy(t *testing.T) {
+	breachedFile := filepath.Join(t.TempDir(), "breached.txt")
+	sum := sha1.Sum([]byte("blue-sky-99.1"))
+	if err := os.WriteFile(breachedFile, []byte(strings.ToUpper(hex.EncodeToString(sum[:]))+":42\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	breached, err := auth.LoadBreachedPasswords(breachedFile)
+	if err != nil {
+		t.Fatalf("LoadBreachedPasswords: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		rule     string
+	}{
+		{name: "too short", password: "Xq9!", rule: auth.RuleMinLength},
+		{name: "easy to guess", password: "password123", rule: auth.RuleStrength},
+		{name: "contains the email", password: "walt@example.com", rule: auth.RuleNotEmail},
+		{name: "breached", password: "blue-sky-99.1", rule: auth.RuleBreached},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.PasswordPolicy = auth.DefaultPasswordPolicy
+			cfg.PasswordPolicy.Breached = breached
+
+			body, _ := json.Marshal(parameters{Email: "walt@example.com", Password: tt.password})
+			rec := httptest.NewRecorder()
+			cfg.handlerUsersCreate(rec, httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewReader(body)))
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+			}
+			var problem struct {
+				Code   string       `json:"code"`
+				Fields []FieldError `json:"fields"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("malformed problem %s: %v", rec.Body, err)
+			}
+			found := false
+			for _, field := range problem.Fields {
+				found = found || (field.Field == "password" && field.Rule == tt.rule)
+			}
+			if problem.Code != CodeValidationFailed || !found {
+				t.Errorf("problem = %+v, want %q with the password breaking %q", problem, CodeValidationFailed, tt.rule)
+			}
+			if _, err := cfg.DB.FindUserByEmail("walt@example.com"); err == nil {
+				t.Error("the user was created with a rejected password")
+			}
+		})
+	}
+}
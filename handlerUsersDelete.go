@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const ChirpPolicyDelete = "delete"
+const ChirpPolicyAnonymize = "anonymize"
+
+const ExportNDJSON = "ndjson"
+const ExportZIP = "zip"
+
+func (cfg *apiConfig) handlerUsersDelete(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	userID := principal.UserID
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.required("password", params.Password)
+	if !errs.ok(w) {
+		return
+	}
+
+	// a stolen access token alone isn't enough to delete an account
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	err = auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "password is incorrect")
+		return
+	}
+
+	err = cfg.deleteUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete user")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUser removes the user, applying the chirp deletion policy, and their uploaded files
+func (cfg *apiConfig) deleteUser(userID int) error {
+	media, err := cfg.DB.DeleteUser(userID, cfg.ChirpDeletionPolicy == ChirpPolicyAnonymize)
+	if err != nil {
+		return err
+	}
+	for _, m := range media {
+		for _, key := range []string{m.Key, m.ThumbnailKey} {
+			err = cfg.Blobs.Delete(key)
+			if err != nil {
+				log.Printf("Couldn't delete blob %s of user %v: %s", key, userID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handlerUsersExport(w http.ResponseWriter, req *http.Request) {
+	type profile struct {
+		ID           int           `json:"id"`
+		Email        string        `json:"email"`
+		IsChirpyRed  bool          `json:"is_chirpy_red"`
+		IsVerified   bool          `json:"is_verified"`
+		Handle       string        `json:"handle"`
+		DisplayName  string        `json:"display_name"`
+		Bio          string        `json:"bio"`
+		AvatarURL    string        `json:"avatar_url"`
+		Subscription *Subscription `json:"subscription,omitempty"`
+	}
+	type record struct {
+		Type string      `json:"type"`
+		Data interface{} `json:"data"`
+	}
+
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	userID := principal.UserID
+
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = ExportNDJSON
+	}
+	if format != ExportNDJSON && format != ExportZIP {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("format must be %s or %s", ExportNDJSON, ExportZIP))
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	chirps, err := cfg.DB.GetUserChirps(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+		return
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].ID < chirps[j].ID
+	})
+	media, err := cfg.DB.GetUserMedia(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve media")
+		return
+	}
+	blocks, mutes, err := cfg.DB.GetRelations(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve blocks and mutes")
+		return
+	}
+	userProfile := profile{
+		ID:           user.ID,
+		Email:        user.Email,
+		IsChirpyRed:  user.IsChirpyRed(),
+		IsVerified:   user.IsVerified,
+		Handle:       user.Handle,
+		DisplayName:  user.DisplayName,
+		Bio:          user.Bio,
+		AvatarURL:    mediaURL(user.Avatar),
+		Subscription: subscriptionResponse(user),
+	}
+	sections := []exportSection{
+		{Type: "chirp", File: "chirps.ndjson"},
+		{Type: "media", File: "media.ndjson"},
+		{Type: "block", File: "blocks.ndjson"},
+		{Type: "mute", File: "mutes.ndjson"},
+	}
+	for _, chirp := range chirps {
+		sections[0].Records = append(sections[0].Records, chirp)
+	}
+	for _, m := range media {
+		sections[1].Records = append(sections[1].Records, newMediaResponse(m))
+	}
+	for _, block := range blocks {
+		sections[2].Records = append(sections[2].Records, block)
+	}
+	for _, mute := range mutes {
+		sections[3].Records = append(sections[3].Records, mute)
+	}
+
+	if format == ExportNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="chirpy-export.ndjson"`)
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		err = encoder.Encode(record{Type: "user", Data: userProfile})
+		for _, section := range sections {
+			for _, data := range section.Records {
+				if err != nil {
+					break
+				}
+				err = encoder.Encode(record{Type: section.Type, Data: data})
+			}
+		}
+		if err != nil {
+			log.Printf("Couldn't stream export for user %v: %s", userID, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-export.zip"`)
+	w.WriteHeader(http.StatusOK)
+	err = writeExportZip(w, userProfile, sections)
+	if err != nil {
+		log.Printf("Couldn't stream export for user %v: %s", userID, err)
+	}
+}
+
+// exportSection is one type of record in an export, kept in its own file of a ZIP
+type exportSection struct {
+	Type    string
+	File    string
+	Records []interface{}
+}
+
+// writeExportZip writes the profile as profile.json and each section's records
+// one per line to the section's file
+func writeExportZip(w io.Writer, userProfile interface{}, sections []exportSection) error {
+	archive := zip.NewWriter(w)
+
+	f, err := archive.Create("profile.json")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(userProfile)
+	if err != nil {
+		return err
+	}
+
+	for _, section := range sections {
+		f, err = archive.Create(section.File)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		for _, data := range section.Records {
+			err = encoder.Encode(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsersExport(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	other := createTestUser(t, cfg.DB, "jesse@example.com")
+	handle, bio := "heisenberg", "I am the danger"
+	if _, err := cfg.DB.ChangeUser(user.ID, UserChanges{Handle: &handle, Bio: &bio}); err != nil {
+		t.Fatalf("ChangeUser: %v", err)
+	}
+	if _, err := cfg.DB.CreateMedia(Media{ID: "photo", OwnerID: user.ID, Key: "photo.png"}); err != nil {
+		t.Fatalf("CreateMedia: %v", err)
+	}
+	if _, err := cfg.DB.CreateChirp("say my name", user.ID, []string{"photo"}); err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	if err := cfg.DB.BlockUser(user.ID, other.ID); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+	if err := cfg.DB.MuteUser(user.ID, other.ID); err != nil {
+		t.Fatalf("MuteUser: %v", err)
+	}
+
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/api/users/me/export", nil), user.ID)
+	rec := httptest.NewRecorder()
+	cfg.handlerUsersExport(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	records := map[string]int{}
+	var profile struct {
+		Handle string `json:"handle"`
+		Bio    string `json:"bio"`
+	}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var record struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("malformed record %s: %v", scanner.Bytes(), err)
+		}
+		records[record.Type]++
+		if record.Type == "user" {
+			if err := json.Unmarshal(record.Data, &profile); err != nil {
+				t.Fatalf("malformed profile: %v", err)
+			}
+		}
+	}
+
+	for _, recordType := range []string{"user", "chirp", "media", "block", "mute"} {
+		if records[recordType] != 1 {
+			t.Errorf("got %d %s records, want 1", records[recordType], recordType)
+		}
+	}
+	if profile.Handle != handle || profile.Bio != bio {
+		t.Errorf("exported profile = %+v, want handle %q and bio %q", profile, handle, bio)
+	}
+}
+
+func TestUsersExportIncludesDeletedChirps(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	kept, err := cfg.DB.CreateChirp("say my name", user.ID, nil)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	deleted, err := cfg.DB.CreateChirp("I am the one who knocks", user.ID, nil)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	if err := cfg.DB.DeleteChirp(deleted.ID, user.ID); err != nil {
+		t.Fatalf("DeleteChirp: %v", err)
+	}
+
+	req := authenticated(httptest.NewRequest(http.MethodGet, "/api/users/me/export", nil), user.ID)
+	rec := httptest.NewRecorder()
+	cfg.handlerUsersExport(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	chirps := []Chirp{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var record struct {
+			Type string `json:"type"`
+			Data Chirp  `json:"data"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("malformed record %s: %v", scanner.Bytes(), err)
+		}
+		if record.Type == "chirp" {
+			chirps = append(chirps, record.Data)
+		}
+	}
+
+	if len(chirps) != 2 || chirps[0].ID != kept.ID || chirps[1].ID != deleted.ID {
+		t.Fatalf("exported chirps %+v, want chirps %d and %d", chirps, kept.ID, deleted.ID)
+	}
+	if chirps[0].DeletedAt != nil {
+		t.Errorf("chirp %d is exported as deleted", kept.ID)
+	}
+	if chirps[1].DeletedAt == nil || time.Since(*chirps[1].DeletedAt) > time.Minute {
+		t.Errorf("chirp %d is exported without when it was deleted", deleted.ID)
+	}
+}
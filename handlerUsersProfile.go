@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const maxDisplayNameLength = 50
+const maxBioLength = 160
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,15}$`)
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_])@([A-Za-z0-9_]{3,15})`)
+
+// handles that would collide with other /api/users routes
+var reservedHandles = []string{"me", "verify"}
+
+type profileResponse struct {
+	ID          int    `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatar_url"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+}
+
+func (cfg *apiConfig) handlerUsersGetByHandle(w http.ResponseWriter, req *http.Request) {
+	handle := strings.TrimPrefix(req.PathValue("handle"), "@")
+	user, err := cfg.DB.FindUserByHandle(handle)
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, profileResponse{
+		ID:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   mediaURL(user.Avatar),
+		IsChirpyRed: user.IsChirpyRed(),
+	})
+}
+
+func (cfg *apiConfig) handlerUsersGetMe(w http.ResponseWriter, req *http.Request) {
+	type meResponse struct {
+		profileResponse
+		Email        string        `json:"email"`
+		IsVerified   bool          `json:"is_verified"`
+		Plan         string        `json:"plan"`
+		Subscription *Subscription `json:"subscription,omitempty"`
+		Entitlements Entitlements  `json:"entitlements"`
+	}
+
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	userID := principal.UserID
+
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, meResponse{
+		profileResponse: profileResponse{
+			ID:          user.ID,
+			Handle:      user.Handle,
+			DisplayName: user.DisplayName,
+			Bio:         user.Bio,
+			AvatarURL:   mediaURL(user.Avatar),
+			IsChirpyRed: user.IsChirpyRed(),
+		},
+		Email:        user.Email,
+		IsVerified:   user.IsVerified,
+		Plan:         user.Plan(),
+		Subscription: subscriptionResponse(user),
+		Entitlements: cfg.Entitlements.For(user),
+	})
+}
+
+// validateProfile normalizes a handle, dropping a leading @, and checks the profile fields
+func validateProfile(errs *fieldErrors, handle, displayName, bio string) string {
+	handle = strings.TrimPrefix(handle, "@")
+	if handle != "" && !handlePattern.MatchString(handle) {
+		errs.add("handle", RuleFormat, "handle must be 3 to 15 letters, digits or underscores")
+	}
+	for _, reserved := range reservedHandles {
+		if strings.EqualFold(handle, reserved) {
+			errs.add("handle", RuleInvalid, "handle is reserved")
+		}
+	}
+	errs.maxLength("display_name", displayName, maxDisplayNameLength)
+	errs.maxLength("bio", bio, maxBioLength)
+	return handle
+}
+
+// withAuthors embeds a summary of each chirp's author
+func (cfg *apiConfig) withAuthors(chirps []Chirp) ([]Chirp, error) {
+	ids := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.AuthorId)
+	}
+	authors, err := cfg.DB.GetAuthors(ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, chirp := range chirps {
+		if author, ok := authors[chirp.AuthorId]; ok {
+			chirps[i].Author = &author
+		}
+	}
+	return chirps, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const VerifyDuration = 60 * 60 * 24
+
+// verifyResendCooldown is how long a user waits before another verification email
+const verifyResendCooldown = time.Minute
+
+func (cfg *apiConfig) handlerUsersVerify(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+	errs := fieldErrors{}
+	errs.required("token", params.Token)
+	if !errs.ok(w) {
+		return
+	}
+
+	claims, err := auth.ValidateJWT(params.Token, cfg.Keys, auth.TypeVerify)
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "verification token is invalid or expired", Cause: err})
+		return
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "verification token is invalid or expired", Cause: err})
+		return
+	}
+
+	user, err := cfg.DB.VerifyUser(userID, claims.Email, auth.HashToken(claims.ID))
+	if errors.Is(err, ErrUserNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "verification token is invalid or was already used", Cause: err})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		ID:          user.ID,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed(),
+		IsVerified:  user.IsVerified,
+	})
+}
+
+func (cfg *apiConfig) handlerUsersVerifyResend(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(principal.UserID)
+	if err != nil {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+		return
+	}
+	err = cfg.sendVerificationEmail(user, verifyResendCooldown)
+	switch {
+	case errors.Is(err, ErrAlreadyVerified):
+		respondWithAPIError(w, newAPIError(http.StatusConflict, CodeAlreadyVerified, "email is already verified"))
+		return
+	case errors.Is(err, ErrVerificationRecent):
+		retryAfter := time.Until(user.VerificationSentAt.Add(verifyResendCooldown))
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		respondWithAPIError(w, newAPIError(http.StatusTooManyRequests, CodeRateLimited, "a verification email was sent recently, try again later"))
+		return
+	case err != nil:
+		respondWithAPIError(w, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Detail: "couldn't send verification email", Cause: err})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendVerificationEmail mails the user a signed token to confirm their email
+// with. The token carries the email and a nonce whose hash is stored on the
+// user, so it only confirms that address and only once. Sending fails while
+// the last token is younger than cooldown
+func (cfg *apiConfig) sendVerificationEmail(user User, cooldown time.Duration) error {
+	nonce, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return err
+	}
+	claims := auth.Claims{Type: auth.TypeVerify, Email: user.Email}
+	claims.ID = nonce
+	token, err := auth.IssueJWT(user.ID, cfg.Keys, time.Duration(VerifyDuration)*time.Second, claims)
+	if err != nil {
+		return err
+	}
+	tokenHash := auth.HashToken(nonce)
+	err = cfg.DB.SetVerificationToken(user.ID, user.Email, tokenHash, cooldown)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Welcome to Chirpy!\n\nConfirm your email by sending this token to POST /api/users/verify within 24 hours:\n\n%s\n", token)
+	err = cfg.Mailer.Send(user.Email, "Verify your Chirpy account", body)
+	if err != nil {
+		// the email never arrived, so it mustn't hold up the next one
+		cancelErr := cfg.DB.CancelVerificationToken(user.ID, tokenHash)
+		if cancelErr != nil {
+			log.Printf("Couldn't cancel verification token for user %v: %s", user.ID, cancelErr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+// testMailer keeps the emails it's asked to send, or fails with err when set
+type testMailer struct {
+	bodies []string
+	err    error
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+// lastToken returns the token at the end of the last email sent
+func (m *testMailer) lastToken(t *testing.T) string {
+	t.Helper()
+	if len(m.bodies) == 0 {
+		t.Fatal("no email was sent")
+	}
+	fields := strings.Fields(m.bodies[len(m.bodies)-1])
+	return fields[len(fields)-1]
+}
+
+func newTestConfig(t *testing.T) (*apiConfig, *testMailer) {
+	t.Helper()
+	keys, err := auth.LoadKeySet(filepath.Join(t.TempDir(), "keys.json"), auth.AlgEdDSA)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	auth.SetErrorWriter(respondWithAuthError)
+	mailer := &testMailer{}
+	db := newTestDB(t)
+	return &apiConfig{
+		DB:           db,
+		Keys:         keys,
+		Mailer:       mailer,
+		Entitlements: NewEntitlementService(db, defaultPlanEntitlements),
+		RateLimits:   NewRateLimiter(),
+	}, mailer
+}
+
+// authenticated returns req as made by the user
+func authenticated(req *http.Request, userID int) *http.Request {
+	return req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{UserID: userID, Role: RoleUser}))
+}
+
+func verify(cfg *apiConfig, token string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"token": token})
+	req := httptest.NewRequest(http.MethodPost, "/api/users/verify", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	cfg.handlerUsersVerify(rec, req)
+	return rec
+}
+
+func TestVerifyTokenIsSingleUse(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	if err := cfg.sendVerificationEmail(user, 0); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	token := mailer.lastToken(t)
+
+	if rec := verify(cfg, token); rec.Code != http.StatusOK {
+		t.Fatalf("first use: got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := verify(cfg, token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("second use: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestVerifyTokenIsBoundToEmail(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	if err := cfg.sendVerificationEmail(user, 0); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	token := mailer.lastToken(t)
+
+	email := "heisenberg@example.com"
+	if _, err := cfg.DB.ChangeUser(user.ID, UserChanges{Email: &email}); err != nil {
+		t.Fatalf("ChangeUser: %v", err)
+	}
+	if rec := verify(cfg, token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token for the old email: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	user, err := cfg.DB.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.IsVerified {
+		t.Error("the new email was verified with a token sent to the old one")
+	}
+}
+
+func TestVerifyTokenIsReplacedBySendingAnother(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	if err := cfg.sendVerificationEmail(user, 0); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	first := mailer.lastToken(t)
+	if err := cfg.sendVerificationEmail(user, 0); err != nil {
+		t.Fatalf("sendVerificationEmail: %v", err)
+	}
+	second := mailer.lastToken(t)
+
+	if rec := verify(cfg, first); rec.Code != http.StatusUnauthorized {
+		t.Errorf("replaced token: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := verify(cfg, second); rec.Code != http.StatusOK {
+		t.Errorf("latest token: got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+}
+
+func TestVerifyResend(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	resend := func() *httptest.ResponseRecorder {
+		req := authenticated(httptest.NewRequest(http.MethodPost, "/api/users/verify/resend", nil), user.ID)
+		rec := httptest.NewRecorder()
+		cfg.handlerUsersVerifyResend(rec, req)
+		return rec
+	}
+
+	// backfilled users never had a token sent
+	if rec := resend(); rec.Code != http.StatusAccepted {
+		t.Fatalf("resend: got %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	rec := resend()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("resend within the cooldown: got %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("resend within the cooldown has no Retry-After header")
+	}
+	if len(mailer.bodies) != 1 {
+		t.Errorf("sent %d emails, want 1", len(mailer.bodies))
+	}
+
+	if rec := verify(cfg, mailer.lastToken(t)); rec.Code != http.StatusOK {
+		t.Fatalf("verify: got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := resend(); rec.Code != http.StatusConflict {
+		t.Errorf("resend once verified: got %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestVerifyResendAfterFailedEmail(t *testing.T) {
+	cfg, mailer := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	resend := func() *httptest.ResponseRecorder {
+		req := authenticated(httptest.NewRequest(http.MethodPost, "/api/users/verify/resend", nil), user.ID)
+		rec := httptest.NewRecorder()
+		cfg.handlerUsersVerifyResend(rec, req)
+		return rec
+	}
+
+	mailer.err = errors.New("smtp server is down")
+	if rec := resend(); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("resend with a failing mailer: got %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	// the email that failed doesn't count towards the cooldown
+	mailer.err = nil
+	if rec := resend(); rec.Code != http.StatusAccepted {
+		t.Fatalf("resend once the mailer works: got %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	if rec := verify(cfg, mailer.lastToken(t)); rec.Code != http.StatusOK {
+		t.Errorf("verify: got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const maxWebhookURLLength = 2048
+
+type webhookResponse struct {
+	ID      string   `json:"id"`
+	OwnerID int      `json:"owner_id"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Global  bool     `json:"global"`
+	// Secret is only returned when the webhook is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookResponse(hook Webhook) webhookResponse {
+	return webhookResponse{
+		ID:        hook.ID,
+		OwnerID:   hook.OwnerID,
+		URL:       hook.URL,
+		Events:    hook.Events,
+		Global:    hook.Global,
+		CreatedAt: hook.CreatedAt,
+	}
+}
+
+// handlerWebhooksCreate registers a webhook for events about the authenticated user
+func (cfg *apiConfig) handlerWebhooksCreate(w http.ResponseWriter, req *http.Request) {
+	cfg.createWebhook(w, req, false)
+}
+
+// handlerAdminWebhooksCreate registers a webhook for events about every user
+func (cfg *apiConfig) handlerAdminWebhooksCreate(w http.ResponseWriter, req *http.Request) {
+	cfg.createWebhook(w, req, true)
+}
+
+func (cfg *apiConfig) createWebhook(w http.ResponseWriter, req *http.Request, global bool) {
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	params := parameters{}
+	if !decodeJSON(w, req, &params) {
+		return
+	}
+
+	errs := fieldErrors{}
+	if errs.required("url", params.URL) {
+		errs.maxLength("url", params.URL, maxWebhookURLLength)
+		if cfg.Webhooks.CheckURL(params.URL) != nil {
+			errs.add("url", RuleFormat, "url must be an https address reachable from the internet")
+		}
+	}
+	if len(params.Events) == 0 {
+		errs.add("events", RuleRequired, "events is required")
+	}
+	for _, event := range params.Events {
+		if !webhookEvents[event] {
+			errs.add("events", RuleInvalid, fmt.Sprintf("%s is not an event", event))
+		}
+	}
+	if !errs.ok(w) {
+		return
+	}
+
+	if !global {
+		user, err := cfg.DB.GetUser(principal.UserID)
+		if err != nil {
+			respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found"))
+			return
+		}
+		if !user.IsVerified {
+			respondWithAPIError(w, newAPIError(http.StatusForbidden, CodeEmailNotVerified, "email must be verified before adding webhooks"))
+			return
+		}
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	secret, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hook, err := cfg.DB.CreateWebhook(Webhook{
+		ID:        id,
+		OwnerID:   principal.UserID,
+		URL:       params.URL,
+		Events:    params.Events,
+		Global:    global,
+		Secret:    "whsec_" + secret,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook")
+		return
+	}
+
+	resp := newWebhookResponse(hook)
+	resp.Secret = hook.Secret
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+func (cfg *apiConfig) handlerWebhooksGet(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	cfg.respondWithWebhooks(w, principal.UserID)
+}
+
+// handlerAdminWebhooksGet lists every user's webhooks as well as global ones
+func (cfg *apiConfig) handlerAdminWebhooksGet(w http.ResponseWriter, req *http.Request) {
+	cfg.respondWithWebhooks(w, 0)
+}
+
+func (cfg *apiConfig) respondWithWebhooks(w http.ResponseWriter, userID int) {
+	hooks, err := cfg.DB.GetWebhooks(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve webhooks")
+		return
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+	})
+
+	resp := make([]webhookResponse, 0, len(hooks))
+	for _, hook := range hooks {
+		resp = append(resp, newWebhookResponse(hook))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerWebhooksDelete lets owners delete their webhooks and admins delete any webhook
+func (cfg *apiConfig) handlerWebhooksDelete(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	err := cfg.DB.DeleteWebhook(req.PathValue("webhookID"), principal.UserID)
+	if errors.Is(err, ErrWebhookNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeWebhookNotFound, "webhook not found"))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWebhookDeliveriesGet returns a webhook's delivery log, newest first
+func (cfg *apiConfig) handlerWebhookDeliveriesGet(w http.ResponseWriter, req *http.Request) {
+	principal, ok := auth.PrincipalFromContext(req.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "request is not authenticated")
+		return
+	}
+	hook, err := cfg.DB.GetWebhook(req.PathValue("webhookID"), principal.UserID)
+	if errors.Is(err, ErrWebhookNotFound) {
+		respondWithAPIError(w, newAPIError(http.StatusNotFound, CodeWebhookNotFound, "webhook not found"))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve webhook")
+		return
+	}
+
+	deliveries, err := cfg.DB.GetWebhookDeliveries(hook.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve deliveries")
+		return
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,50 +16,161 @@ import (
 
 var ErrNoAuthHeaderIncluded = errors.New("not auth header included in request")
 
-func HashPassword(pwd string) (string, error) {
-	dat, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
+// passwordHashers hashes new passwords with current and verifies hashes made by any
+// of its hashers, so the algorithm or its parameters can change without locking users out
+type passwordHashers struct {
+	Current PasswordHasher
+	Legacy  []PasswordHasher
+}
+
+var passwords = passwordHashers{
+	Current: DefaultArgon2id,
+	Legacy:  []PasswordHasher{BcryptHasher{Cost: bcrypt.DefaultCost}},
+}
+
+// SetPasswordHasher changes how new passwords are hashed. Hashes from the
+// previous hasher are still verified and reported by NeedsRehash
+func SetPasswordHasher(hasher PasswordHasher) {
+	passwords = passwordHashers{
+		Current: hasher,
+		Legacy:  append([]PasswordHasher{passwords.Current}, passwords.Legacy...),
 	}
-	return string(dat), nil
+}
+
+func HashPassword(pwd string) (string, error) {
+	return passwords.Current.Hash(pwd)
 }
 
 func CheckPasswordHash(pwd, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd))
+	for _, hasher := range append([]PasswordHasher{passwords.Current}, passwords.Legacy...) {
+		if hasher.Recognizes(hash) {
+			return hasher.Verify(pwd, hash)
+		}
+	}
+	return ErrUnknownHashFormat
+}
+
+// NeedsRehash reports whether a verified hash should be replaced with HashPassword's output
+func NeedsRehash(hash string) bool {
+	return !passwords.Current.Recognizes(hash) || passwords.Current.NeedsRehash(hash)
+}
+
+// Issuer and Audience are set on every token and required when validating
+const Issuer = "chirpy"
+const Audience = "chirpy-api"
+
+// Token types, carried in the typ claim so one kind of token can't stand in for another
+const TypeAccess = "access"
+const TypeVerify = "verify"
+
+// TypeMFA tokens prove the password was checked and a second factor is still required
+const TypeMFA = "mfa"
+
+// Leeway is the clock skew allowed when checking exp, nbf and iat
+const Leeway = 30 * time.Second
+
+var ErrWrongTokenType = errors.New("token type not accepted")
+var ErrMissingTokenID = errors.New("token has no jti claim")
+
+// Claims are the registered JWT claims plus the token type and the user's role,
+// which is only set on access tokens
+type Claims struct {
+	jwt.RegisteredClaims
+	Type string `json:"typ"`
+	Role string `json:"role,omitempty"`
+	// Email is the address a verification token confirms
+	Email string `json:"email,omitempty"`
+	// SessionID is the login session an access token belongs to
+	SessionID string `json:"sid,omitempty"`
 }
 
-func MakeJWT(userID int, tokenSecret string, expiresIn time.Duration, issuer string) (string, error) {
-	signingKey := []byte(tokenSecret)
+// UserID returns the user the token was issued to
+func (c *Claims) UserID() (int, error) {
+	userID, err := strconv.Atoi(c.Subject)
+	if err != nil {
+		return 0, errors.New("token subject is not a user id")
+	}
+	return userID, nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    issuer,
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   fmt.Sprintf("%d", userID),
-	})
-	return token.SignedString(signingKey)
+func MakeJWT(userID int, keys *KeySet, expiresIn time.Duration, tokenType string, role string) (string, error) {
+	return IssueJWT(userID, keys, expiresIn, Claims{Type: tokenType, Role: role})
+}
+
+// IssueJWT signs claims for the user after filling in the registered claims.
+// A jti is generated unless claims already has one
+func IssueJWT(userID int, keys *KeySet, expiresIn time.Duration, claims Claims) (string, error) {
+	tokenID := claims.ID
+	if tokenID == "" {
+		var err error
+		tokenID, err = newTokenID()
+		if err != nil {
+			return "", err
+		}
+	}
+	now := time.Now().UTC()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    Issuer,
+		Audience:  jwt.ClaimStrings{Audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+		Subject:   strconv.Itoa(userID),
+		ID:        tokenID,
+	}
+	return keys.sign(claims)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (string, string, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
+// ValidateJWT checks a token's signature, issuer, audience, lifetime and type
+// and returns its claims
+func ValidateJWT(tokenString string, keys *KeySet, tokenType string) (*Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(
 		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		&claims,
+		keys.keyFunc,
+		jwt.WithValidMethods([]string{AlgEdDSA, AlgRS256}),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(Leeway),
 	)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	userIDString, err := token.Claims.GetSubject()
+	if claims.ID == "" {
+		return nil, ErrMissingTokenID
+	}
+	if claims.Type != tokenType {
+		return nil, ErrWrongTokenType
+	}
+	return &claims, nil
+}
+
+func newTokenID() (string, error) {
+	dat := make([]byte, 16)
+	_, err := rand.Read(dat)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
-	tokenIssuer, err := token.Claims.GetIssuer()
+	return hex.EncodeToString(dat), nil
+}
+
+// MakeOpaqueToken returns a random hex token for single use links
+func MakeOpaqueToken() (string, error) {
+	dat := make([]byte, 32)
+	_, err := rand.Read(dat)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
+	return hex.EncodeToString(dat), nil
+}
 
-	return userIDString, tokenIssuer, nil
+// HashToken returns the hex SHA-256 of a token so it can be stored instead of the token itself
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 func GetBearerToken(headers http.Header, tokenName string) (string, error) {
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestKeySet(t *testing.T, alg string) *KeySet {
+	t.Helper()
+	keys, err := LoadKeySet(filepath.Join(t.TempDir(), "keys.json"), alg)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	return keys
+}
+
+func TestValidateJWT(t *testing.T) {
+	keys := newTestKeySet(t, AlgEdDSA)
+	signingKey := keys.keys[len(keys.keys)-1]
+	now := time.Now()
+
+	// validClaims returns the claims MakeJWT would issue for an access token
+	validClaims := func() *Claims {
+		return &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    Issuer,
+				Audience:  jwt.ClaimStrings{Audience},
+				Subject:   "1",
+				ID:        "token-id",
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+			Type: TypeAccess,
+		}
+	}
+	// sign signs claims with method and key, naming kid as the key in the header
+	sign := func(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims *Claims) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		return signed
+	}
+	signed := func(t *testing.T, change func(*Claims)) string {
+		claims := validClaims()
+		change(claims)
+		return sign(t, jwt.SigningMethodEdDSA, signingKey.Private, signingKey.ID, claims)
+	}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+		// wantErr is checked with errors.Is when set, otherwise any error is expected
+		wantErr error
+		valid   bool
+	}{
+		{
+			name:  "valid",
+			token: func(t *testing.T) string { return signed(t, func(c *Claims) {}) },
+			valid: true,
+		},
+		{
+			name: "expired within the leeway",
+			token: func(t *testing.T) string {
+				return signed(t, func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-Leeway / 2)) })
+			},
+			valid: true,
+		},
+		{
+			name: "HS256 signed with the public key",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				public := signingKey.Private.Public().(ed25519.PublicKey)
+				return sign(t, jwt.SigningMethodHS256, []byte(public), signingKey.ID, claims)
+			},
+			wantErr: jwt.ErrTokenSignatureInvalid,
+		},
+		{
+			name: "alg none",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, signingKey.ID, validClaims())
+			},
+			wantErr: jwt.ErrTokenSignatureInvalid,
+		},
+		{
+			name:    "bad issuer",
+			token:   func(t *testing.T) string { return signed(t, func(c *Claims) { c.Issuer = "someone-else" }) },
+			wantErr: jwt.ErrTokenInvalidIssuer,
+		},
+		{
+			name: "bad audience",
+			token: func(t *testing.T) string {
+				return signed(t, func(c *Claims) { c.Audience = jwt.ClaimStrings{"other-api"} })
+			},
+			wantErr: jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name:    "missing exp",
+			token:   func(t *testing.T) string { return signed(t, func(c *Claims) { c.ExpiresAt = nil }) },
+			wantErr: jwt.ErrTokenRequiredClaimMissing,
+		},
+		{
+			name: "expired beyond the leeway",
+			token: func(t *testing.T) string {
+				return signed(t, func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-2 * Leeway)) })
+			},
+			wantErr: jwt.ErrTokenExpired,
+		},
+		{
+			name: "issued in the future beyond the leeway",
+			token: func(t *testing.T) string {
+				return signed(t, func(c *Claims) { c.IssuedAt = jwt.NewNumericDate(now.Add(2 * Leeway)) })
+			},
+			wantErr: jwt.ErrTokenUsedBeforeIssued,
+		},
+		{
+			name:    "missing jti",
+			token:   func(t *testing.T) string { return signed(t, func(c *Claims) { c.ID = "" }) },
+			wantErr: ErrMissingTokenID,
+		},
+		{
+			name:    "wrong typ",
+			token:   func(t *testing.T) string { return signed(t, func(c *Claims) { c.Type = TypeVerify }) },
+			wantErr: ErrWrongTokenType,
+		},
+		{
+			name: "unknown kid",
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodEdDSA, signingKey.Private, "unknown", validClaims())
+			},
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name: "signed by a key outside the set",
+			token: func(t *testing.T) string {
+				other := newTestKeySet(t, AlgEdDSA)
+				otherKey := other.keys[len(other.keys)-1]
+				return sign(t, jwt.SigningMethodEdDSA, otherKey.Private, signingKey.ID, validClaims())
+			},
+			wantErr: jwt.ErrTokenSignatureInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ValidateJWT(tt.token(t), keys, TypeAccess)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("ValidateJWT: %v", err)
+				}
+				if userID, err := claims.UserID(); err != nil || userID != 1 {
+					t.Errorf("UserID() = %d, %v, want 1", userID, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("ValidateJWT accepted the token")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateJWT: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMakeJWTRoundTrip(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		t.Run(alg, func(t *testing.T) {
+			keys := newTestKeySet(t, alg)
+			token, err := MakeJWT(7, keys, time.Minute, TypeAccess, "admin")
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+			claims, err := ValidateJWT(token, keys, TypeAccess)
+			if err != nil {
+				t.Fatalf("ValidateJWT: %v", err)
+			}
+			if userID, _ := claims.UserID(); userID != 7 || claims.Role != "admin" || claims.ID == "" {
+				t.Errorf("claims = %+v, want user 7 with the admin role and a jti", claims)
+			}
+		})
+	}
+}
@@ -6,3 +6,5 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	golang.org/x/crypto v0.22.0
 )
+
+require golang.org/x/sys v0.19.0 // indirect
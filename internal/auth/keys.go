@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const AlgRS256 = "RS256"
+const AlgEdDSA = "EdDSA"
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+type signingKey struct {
+	ID        string
+	Alg       string
+	Private   crypto.Signer
+	CreatedAt time.Time
+	// RetiredAt is set once the key stops signing. It still verifies tokens until it's pruned
+	RetiredAt time.Time
+}
+
+// KeySet signs tokens with its newest key and verifies them with any key that
+// hasn't been pruned, looking keys up by the kid header. Keys are saved to a file
+// so tokens stay valid across restarts
+type KeySet struct {
+	mux  *sync.RWMutex
+	path string
+	alg  string
+	// keys are ordered oldest first, the last one is the signing key
+	keys []signingKey
+}
+
+type keyFile struct {
+	Keys []keyFileEntry `json:"keys"`
+}
+
+type keyFileEntry struct {
+	ID         string    `json:"kid"`
+	Alg        string    `json:"alg"`
+	PrivateKey string    `json:"private_key"`
+	CreatedAt  time.Time `json:"created_at"`
+	RetiredAt  time.Time `json:"retired_at"`
+}
+
+// LoadKeySet reads the keys saved at path, creating a first key with alg if
+// the file doesn't exist
+func LoadKeySet(path, alg string) (*KeySet, error) {
+	if alg != AlgRS256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %s", alg)
+	}
+	ks := &KeySet{
+		mux:  &sync.RWMutex{},
+		path: path,
+		alg:  alg,
+	}
+
+	dat, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := newSigningKey(alg)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys = []signingKey{key}
+		return ks, ks.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := keyFile{}
+	err = json.Unmarshal(dat, &file)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range file.Keys {
+		block, _ := pem.Decode([]byte(entry.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("key %s is not PEM encoded", entry.ID)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key %s can't sign", entry.ID)
+		}
+		ks.keys = append(ks.keys, signingKey{
+			ID:        entry.ID,
+			Alg:       entry.Alg,
+			Private:   private,
+			CreatedAt: entry.CreatedAt,
+			RetiredAt: entry.RetiredAt,
+		})
+	}
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+	return ks, nil
+}
+
+// Rotate starts signing with a new key. The previous key keeps verifying tokens,
+// and keys retired more than retain ago are pruned
+func (ks *KeySet) Rotate(retain time.Duration) error {
+	key, err := newSigningKey(ks.alg)
+	if err != nil {
+		return err
+	}
+
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+
+	now := time.Now().UTC()
+	keys := []signingKey{}
+	for _, k := range ks.keys {
+		if k.RetiredAt.IsZero() {
+			k.RetiredAt = now
+		}
+		if now.Sub(k.RetiredAt) <= retain {
+			keys = append(keys, k)
+		}
+	}
+	ks.keys = append(keys, key)
+	return ks.save()
+}
+
+// SigningKeyAge returns how long the current signing key has been in use
+func (ks *KeySet) SigningKeyAge() time.Duration {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+	return time.Since(ks.keys[len(ks.keys)-1].CreatedAt)
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	ks.mux.RLock()
+	key := ks.keys[len(ks.keys)-1]
+	ks.mux.RUnlock()
+
+	token := jwt.NewWithClaims(signingMethod(key.Alg), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// keyFunc returns the key a token was signed with, refusing tokens whose
+// algorithm doesn't match the key
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+	for _, key := range ks.keys {
+		if key.ID == kid {
+			if token.Method.Alg() != key.Alg {
+				return nil, fmt.Errorf("key %s doesn't sign with %s", kid, token.Method.Alg())
+			}
+			return key.Private.Public(), nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWK is a public key in RFC 7517 format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every key that can verify tokens
+func (ks *KeySet) JWKS() JWKS {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		jwk := JWK{
+			Kid: key.ID,
+			Alg: key.Alg,
+			Use: "sig",
+		}
+		switch public := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// save writes the keys to disk, the caller must hold the lock or be the only user of ks
+func (ks *KeySet) save() error {
+	file := keyFile{Keys: []keyFileEntry{}}
+	for _, key := range ks.keys {
+		dat, err := x509.MarshalPKCS8PrivateKey(key.Private)
+		if err != nil {
+			return err
+		}
+		file.Keys = append(file.Keys, keyFileEntry{
+			ID:         key.ID,
+			Alg:        key.Alg,
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: dat})),
+			CreatedAt:  key.CreatedAt,
+			RetiredAt:  key.RetiredAt,
+		})
+	}
+	dat, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ks.path, dat, 0600)
+}
+
+func newSigningKey(alg string) (signingKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %s", alg)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	kid := make([]byte, 8)
+	_, err = rand.Read(kid)
+	if err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{
+		ID:        hex.EncodeToString(kid),
+		Alg:       alg,
+		Private:   private,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	if alg == AlgRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenKid returns the kid header of token without verifying it
+func tokenKid(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func jwksKids(keys *KeySet) map[string]bool {
+	kids := map[string]bool{}
+	for _, jwk := range keys.JWKS().Keys {
+		kids[jwk.Kid] = true
+	}
+	return kids
+}
+
+func TestKeyRotation(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		t.Run(alg, func(t *testing.T) {
+			keys := newTestKeySet(t, alg)
+			oldToken, err := MakeJWT(7, keys, time.Minute, TypeAccess, "")
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+
+			if err := keys.Rotate(time.Hour); err != nil {
+				t.Fatalf("Rotate: %v", err)
+			}
+			newToken, err := MakeJWT(7, keys, time.Minute, TypeAccess, "")
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+			oldKid, newKid := tokenKid(t, oldToken), tokenKid(t, newToken)
+			if oldKid == "" || oldKid == newKid {
+				t.Fatalf("kids before and after rotating = %q and %q, want two different kids", oldKid, newKid)
+			}
+			for _, token := range []string{oldToken, newToken} {
+				if _, err := ValidateJWT(token, keys, TypeAccess); err != nil {
+					t.Errorf("ValidateJWT of the token signed by %s: %v", tokenKid(t, token), err)
+				}
+			}
+			if kids := jwksKids(keys); len(kids) != 2 || !kids[oldKid] || !kids[newKid] {
+				t.Errorf("JWKS kids = %v, want %s and %s", kids, oldKid, newKid)
+			}
+
+			// the rotated keys are saved, so tokens survive a restart
+			reloaded, err := LoadKeySet(keys.path, alg)
+			if err != nil {
+				t.Fatalf("LoadKeySet: %v", err)
+			}
+			if _, err := ValidateJWT(oldToken, reloaded, TypeAccess); err != nil {
+				t.Errorf("ValidateJWT after reloading: %v", err)
+			}
+			token, err := MakeJWT(7, reloaded, time.Minute, TypeAccess, "")
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+			if kid := tokenKid(t, token); kid != newKid {
+				t.Errorf("reloaded keys sign with %s, want %s", kid, newKid)
+			}
+		})
+	}
+}
+
+func TestKeyRotationPrunesRetiredKeys(t *testing.T) {
+	keys := newTestKeySet(t, AlgEdDSA)
+	oldToken, err := MakeJWT(7, keys, time.Minute, TypeAccess, "")
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	if err := keys.Rotate(time.Hour); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	keys.keys[0].RetiredAt = time.Now().Add(-2 * time.Hour)
+
+	if err := keys.Rotate(time.Hour); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if _, err := ValidateJWT(oldToken, keys, TypeAccess); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("ValidateJWT with a pruned key: got %v, want %v", err, ErrUnknownKey)
+	}
+	if kids := jwksKids(keys); len(kids) != 2 || kids[tokenKid(t, oldToken)] {
+		t.Errorf("JWKS kids = %v, want the two newest keys", kids)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	t.Run(AlgEdDSA, func(t *testing.T) {
+		keys := newTestKeySet(t, AlgEdDSA)
+		jwks := keys.JWKS()
+		if len(jwks.Keys) != 1 {
+			t.Fatalf("got %d keys, want 1", len(jwks.Keys))
+		}
+		jwk := jwks.Keys[0]
+		key := keys.keys[0]
+		if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.Alg != AlgEdDSA || jwk.Use != "sig" || jwk.Kid != key.ID {
+			t.Errorf("jwk = %+v, want an Ed25519 signing key with kid %s", jwk, key.ID)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || !ed25519.PublicKey(x).Equal(key.Private.Public()) {
+			t.Errorf("x = %q doesn't hold the public key", jwk.X)
+		}
+		if jwk.N != "" || jwk.E != "" {
+			t.Errorf("jwk = %+v has RSA fields", jwk)
+		}
+	})
+	t.Run(AlgRS256, func(t *testing.T) {
+		keys := newTestKeySet(t, AlgRS256)
+		jwks := keys.JWKS()
+		if len(jwks.Keys) != 1 {
+			t.Fatalf("got %d keys, want 1", len(jwks.Keys))
+		}
+		jwk := jwks.Keys[0]
+		public := keys.keys[0].Private.Public().(*rsa.PublicKey)
+		if jwk.Kty != "RSA" || jwk.Alg != AlgRS256 || jwk.Use != "sig" {
+			t.Errorf("jwk = %+v, want an RSA signing key", jwk)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil || new(big.Int).SetBytes(n).Cmp(public.N) != 0 {
+			t.Errorf("n = %q doesn't hold the modulus", jwk.N)
+		}
+		if jwk.E != "AQAB" {
+			t.Errorf("e = %q, want AQAB", jwk.E)
+		}
+		if jwk.Crv != "" || jwk.X != "" {
+			t.Errorf("jwk = %+v has OKP fields", jwk)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const realm = "chirpy"
+
+// Principal is the authenticated user making a request
+type Principal struct {
+	UserID    int
+	Role      string
+	SessionID string
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stored by RequireAuth or OptionalAuth
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// RequireAuth returns middleware that only lets requests with a valid Bearer token
+// of tokenType through, storing their Principal in the request context
+func RequireAuth(keys *KeySet, tokenType string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := authenticate(r, keys, tokenType)
+			if err != nil {
+				Unauthorized(w, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// OptionalAuth is like RequireAuth but also lets requests without an Authorization
+// header through, without a Principal
+func OptionalAuth(keys *KeySet, tokenType string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		required := RequireAuth(keys, tokenType)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			required.ServeHTTP(w, r)
+		})
+	}
+}
+
+func authenticate(r *http.Request, keys *KeySet, tokenType string) (Principal, error) {
+	bearerToken, err := GetBearerToken(r.Header, "Bearer")
+	if err != nil {
+		return Principal{}, err
+	}
+	claims, err := ValidateJWT(bearerToken, keys, tokenType)
+	if err != nil {
+		return Principal{}, err
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{
+		UserID:    userID,
+		Role:      claims.Role,
+		SessionID: claims.SessionID,
+	}, nil
+}
+
+// Unauthorized responds with 401 and a RFC 6750 challenge. Requests without
+// credentials get a challenge with no error code
+func Unauthorized(w http.ResponseWriter, err error) {
+	challenge := fmt.Sprintf(`Bearer realm="%s"`, realm)
+	code := "unauthorized"
+	if !errors.Is(err, ErrNoAuthHeaderIncluded) {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, err.Error())
+		code = "invalid_token"
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, http.StatusUnauthorized, code, err.Error())
+}
+
+// Forbidden responds with 403 to authenticated requests that lack a privilege
+func Forbidden(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="insufficient_scope", error_description=%q`, realm, msg))
+	writeError(w, http.StatusForbidden, "forbidden", msg)
+}
+
+// ErrorWriter renders the middleware's error responses. code is one of the
+// API's error codes, unauthorized, invalid_token or forbidden
+type ErrorWriter func(w http.ResponseWriter, status int, code, detail string)
+
+var writeError ErrorWriter = func(w http.ResponseWriter, status int, code, detail string) {
+	http.Error(w, detail, status)
+}
+
+// SetErrorWriter makes the middleware render its errors the way the rest of the API does
+func SetErrorWriter(writer ErrorWriter) {
+	writeError = writer
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id is cheap enough to hash with in every test
+var testArgon2id = Argon2idHasher{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// useHasher makes hasher current, with bcrypt as the legacy hasher, until the test ends
+func useHasher(t *testing.T, hasher PasswordHasher) {
+	t.Helper()
+	previous := passwords
+	passwords = passwordHashers{
+		Current: hasher,
+		Legacy:  []PasswordHasher{BcryptHasher{Cost: bcrypt.MinCost}},
+	}
+	t.Cleanup(func() {
+		passwords = previous
+	})
+}
+
+func TestArgon2idHashRoundTrip(t *testing.T) {
+	hash, err := testArgon2id.Hash("say-my-name")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("hash %q isn't in PHC format", hash)
+	}
+	if err := testArgon2id.Verify("say-my-name", hash); err != nil {
+		t.Errorf("Verify with the password: %v", err)
+	}
+	if err := testArgon2id.Verify("say-my-name-2", hash); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Verify with another password: got %v, want %v", err, ErrPasswordMismatch)
+	}
+
+	other, err := testArgon2id.Hash("say-my-name")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if other == hash {
+		t.Error("hashing the same password twice gave the same hash, salts aren't random")
+	}
+}
+
+func TestParseArgon2id(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	tests := []struct {
+		name    string
+		hash    string
+		want    Argon2idHasher
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key,
+			want: Argon2idHasher{Memory: 65536, Iterations: 3, Parallelism: 4, SaltLength: 16, KeyLength: 29},
+		},
+		{name: "argon2i", hash: "$argon2i$v=19$m=65536,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "old version", hash: "$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "missing key", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt, wantErr: true},
+		{name: "malformed parameters", hash: "$argon2id$v=19$m=lots,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "malformed salt", hash: "$argon2id$v=19$m=65536,t=3,p=4$not base64!$" + key, wantErr: true},
+		{name: "malformed key", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$not base64!", wantErr: true},
+		{name: "bcrypt", hash: "$2a$10$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _, _, err := parseArgon2id(tt.hash)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseArgon2id accepted %q", tt.hash)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseArgon2id: %v", err)
+			}
+			if params != tt.want {
+				t.Errorf("parameters = %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	useHasher(t, testArgon2id)
+	current, err := testArgon2id.Hash("say-my-name")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	stronger := testArgon2id
+	stronger.Iterations = 2
+	weaker, err := stronger.Hash("say-my-name")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	longerKey := testArgon2id
+	longerKey.KeyLength = 64
+	otherKey, err := longerKey.Hash("say-my-name")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("say-my-name"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{name: "current parameters", hash: current, want: false},
+		{name: "other iterations", hash: weaker, want: true},
+		{name: "other key length", hash: otherKey, want: true},
+		{name: "bcrypt", hash: string(legacy), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordHashLegacyBcrypt(t *testing.T) {
+	useHasher(t, testArgon2id)
+	legacy, err := bcrypt.GenerateFromPassword([]byte("say-my-name"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	if err := CheckPasswordHash("say-my-name", string(legacy)); err != nil {
+		t.Errorf("CheckPasswordHash with the password: %v", err)
+	}
+	if err := CheckPasswordHash("say-my-name-2", string(legacy)); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("CheckPasswordHash with another password: got %v, want %v", err, ErrPasswordMismatch)
+	}
+	if err := CheckPasswordHash("say-my-name", "plaintext"); !errors.Is(err, ErrUnknownHashFormat) {
+		t.Errorf("CheckPasswordHash of an unknown format: got %v, want %v", err, ErrUnknownHashFormat)
+	}
+
+	// the rehash replacing a legacy hash verifies with the current hasher
+	rehashed, err := HashPassword("say-my-name")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if NeedsRehash(rehashed) {
+		t.Error("a fresh hash needs rehashing")
+	}
+	if err := CheckPasswordHash("say-my-name", rehashed); err != nil {
+		t.Errorf("CheckPasswordHash of the rehash: %v", err)
+	}
+}
+
+func TestSetPasswordHasherKeepsPreviousHashes(t *testing.T) {
+	useHasher(t, testArgon2id)
+	old, err := HashPassword("say-my-name")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	stronger := testArgon2id
+	stronger.Iterations = 2
+	SetPasswordHasher(stronger)
+
+	if err := CheckPasswordHash("say-my-name", old); err != nil {
+		t.Errorf("CheckPasswordHash of a hash from the previous hasher: %v", err)
+	}
+	if !NeedsRehash(old) {
+		t.Error("a hash from the previous hasher doesn't need rehashing")
+	}
+}
+
+func BenchmarkHashPassword(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, err := DefaultArgon2id.Hash("say-my-name-2008")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Password policy rules, reported in PolicyViolation.Rule
+const RuleMinLength = "min_length"
+const RuleMaxLength = "max_length"
+const RuleStrength = "strength"
+const RuleNotEmail = "not_email"
+const RuleBreached = "breached"
+
+// PolicyViolation is one rule a password failed
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy decides which passwords users may choose
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MinStrength is the lowest EstimateStrength score accepted, from 0 to 4
+	MinStrength int
+	// Breached is optional, nil skips the breached password check
+	Breached *BreachedPasswords
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:   8,
+	MaxLength:   256,
+	MinStrength: 2,
+}
+
+// Check returns every rule pwd breaks, or nil when it may be used by the owner of email
+func (p PasswordPolicy) Check(pwd, email string) []PolicyViolation {
+	violations := []PolicyViolation{}
+	length := len([]rune(pwd))
+	if length < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleMaxLength,
+			Message: fmt.Sprintf("password must be at most %d characters", p.MaxLength),
+		})
+	}
+	if email != "" && containsEmail(pwd, email) {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleNotEmail,
+			Message: "password can't contain your email address",
+		})
+	}
+	if EstimateStrength(pwd, email) < p.MinStrength {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleStrength,
+			Message: "password is too easy to guess, try a longer passphrase or mixing in other characters",
+		})
+	}
+	if p.Breached != nil && p.Breached.Count(pwd) > 0 {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleBreached,
+			Message: "password has appeared in a data breach, choose a different one",
+		})
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+func containsEmail(pwd, email string) bool {
+	pwd = strings.ToLower(pwd)
+	email = strings.ToLower(email)
+	local, _, _ := strings.Cut(email, "@")
+	return strings.Contains(pwd, email) || (len(local) >= 4 && strings.Contains(pwd, local))
+}
+
+// commonPasswords are guessed first by every cracker, so they score 0 however long they are
+var commonPasswords = map[string]bool{
+	"password": true, "passw0rd": true, "123456": true, "12345678": true, "123456789": true,
+	"1234567890": true, "qwerty": true, "qwertyuiop": true, "abc123": true, "111111": true,
+	"letmein": true, "welcome": true, "monkey": true, "dragon": true, "iloveyou": true,
+	"admin": true, "login": true, "football": true, "baseball": true, "sunshine": true,
+	"princess": true, "master": true, "shadow": true, "superman": true, "trustno1": true,
+	"chirpy": true, "changeme": true, "secret": true,
+}
+
+// EstimateStrength scores how hard pwd is to guess from 0 (trivial) to 4 (strong),
+// on the same scale as zxcvbn. It estimates guesses from the character classes
+// used, discounting repeated characters, sequences, keyboard runs, common passwords
+// and parts of userInput such as the email address
+func EstimateStrength(pwd, userInput string) int {
+	if pwd == "" {
+		return 0
+	}
+	lower := strings.ToLower(pwd)
+	if commonPasswords[strings.TrimRight(lower, "0123456789!.?")] {
+		return 0
+	}
+	for _, part := range strings.FieldsFunc(strings.ToLower(userInput), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(part) >= 3 {
+			lower = strings.ReplaceAll(lower, part, "~")
+		}
+	}
+
+	charset := 0
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	for _, r := range pwd {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r < unicode.MaxASCII:
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+	}
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{hasLower, 26}, {hasUpper, 26}, {hasDigit, 10}, {hasSymbol, 33}, {hasOther, 100}} {
+		if class.used {
+			charset += class.size
+		}
+	}
+
+	// characters that repeat or continue a run add almost nothing
+	effective := 0.0
+	runes := []rune(lower)
+	for i, r := range runes {
+		if i > 0 && (r == runes[i-1] || r == runes[i-1]+1 || r == runes[i-1]-1 || keyboardAdjacent(runes[i-1], r)) {
+			effective += 0.2
+			continue
+		}
+		effective++
+	}
+
+	log10Guesses := effective * math.Log10(float64(charset))
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]", "asdfghjkl;'", "zxcvbnm,./"}
+
+func keyboardAdjacent(a, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// BreachedPasswords holds SHA-1 hashes of breached passwords split like the
+// Pwned Passwords range API: a 5 character prefix and the remaining suffix
+type BreachedPasswords struct {
+	ranges map[string]map[string]int
+}
+
+// LoadBreachedPasswords reads a file of upper case hex SHA-1 hashes, one
+// HASH:COUNT per line, as produced by the Pwned Passwords downloader
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := &BreachedPasswords{ranges: map[string]map[string]int{}}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		hash, countText, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("%s:%d: expected a SHA-1 hash", path, line)
+		}
+		count := 1
+		if countText != "" {
+			count, err = strconv.Atoi(countText)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad count %q", path, line, countText)
+			}
+		}
+		prefix, suffix := hash[:5], hash[5:]
+		if breached.ranges[prefix] == nil {
+			breached.ranges[prefix] = map[string]int{}
+		}
+		breached.ranges[prefix][suffix] = count
+	}
+	return breached, scanner.Err()
+}
+
+// Count returns how many times pwd was seen in breaches
+func (b *BreachedPasswords) Count(pwd string) int {
+	sum := sha1.Sum([]byte(pwd))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return b.ranges[hash[:5]][hash[5:]]
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeBreachedPasswords writes pwds in the Pwned Passwords HASH:COUNT format
+func writeBreachedPasswords(t *testing.T, pwds ...string) string {
+	t.Helper()
+	lines := []string{}
+	for _, pwd := range pwds {
+		sum := sha1.Sum([]byte(pwd))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":42")
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func violatedRules(violations []PolicyViolation) []string {
+	rules := []string{}
+	for _, violation := range violations {
+		rules = append(rules, violation.Rule)
+	}
+	return rules
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breached, err := LoadBreachedPasswords(writeBreachedPasswords(t, "blue-sky-99.1"))
+	if err != nil {
+		t.Fatalf("LoadBreachedPasswords: %v", err)
+	}
+	policy := DefaultPasswordPolicy
+	policy.Breached = breached
+
+	tests := []struct {
+		name  string
+		pwd   string
+		email string
+		want  []string
+	}{
+		{name: "strong", pwd: "say-my-name-2008", email: "walt@example.com", want: []string{}},
+		{name: "too short", pwd: "Xq9!", want: []string{RuleMinLength}},
+		{name: "too long", pwd: strings.Repeat("say-my-name-2008", 20), want: []string{RuleMaxLength}},
+		{name: "common password", pwd: "password123", want: []string{RuleStrength}},
+		{name: "keyboard run", pwd: "qwertyuiop", want: []string{RuleStrength}},
+		{name: "contains the email", pwd: "heisenberg@example.com", email: "heisenberg@example.com", want: []string{RuleNotEmail}},
+		{name: "breached", pwd: "blue-sky-99.1", want: []string{RuleBreached}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := violatedRules(policy.Check(tt.pwd, tt.email))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check(%q) broke %v, want %v", tt.pwd, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyWithoutBreachedPasswords(t *testing.T) {
+	if violations := DefaultPasswordPolicy.Check("blue-sky-99.1", ""); violations != nil {
+		t.Errorf("Check without breached passwords = %v, want none", violations)
+	}
+}
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	breached, err := LoadBreachedPasswords(writeBreachedPasswords(t, "blue-sky-99.1"))
+	if err != nil {
+		t.Fatalf("LoadBreachedPasswords: %v", err)
+	}
+	if count := breached.Count("blue-sky-99.1"); count != 42 {
+		t.Errorf("Count of a breached password = %d, want 42", count)
+	}
+	if count := breached.Count("say-my-name-2008"); count != 0 {
+		t.Errorf("Count of another password = %d, want 0", count)
+	}
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte("not-a-hash:1\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := LoadBreachedPasswords(path); err == nil {
+		t.Error("LoadBreachedPasswords accepted a line without a SHA-1 hash")
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrMissingSignature = errors.New("request is not signed")
+var ErrMalformedSignature = errors.New("signature header is malformed")
+var ErrStaleSignature = errors.New("signature timestamp is outside the tolerance")
+var ErrInvalidSignature = errors.New("signature does not match")
+var ErrReplayedSignature = errors.New("signature was already used")
+
+// SignPayload returns a signature header, t=<unix time>,v1=<hex HMAC-SHA256 of
+// "<unix time>.<payload>">. Signing the time lets receivers refuse old requests
+func SignPayload(secret string, t time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(payloadMAC(secret, timestamp, payload))
+}
+
+func payloadMAC(secret, timestamp string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// VerifySignature checks a header made by SignPayload with any of secrets, so
+// senders can move to a new secret while the old one is still accepted. The header
+// may carry several v1 signatures, one per secret the sender is signing with.
+// It returns the signed time, which must be within tolerance of now
+func VerifySignature(header string, payload []byte, secrets []string, now time.Time, tolerance time.Duration) (time.Time, error) {
+	if header == "" {
+		return time.Time{}, ErrMissingSignature
+	}
+	timestamp := ""
+	signatures := [][]byte{}
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return time.Time{}, ErrMalformedSignature
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature, err := hex.DecodeString(value)
+			if err != nil {
+				return time.Time{}, ErrMalformedSignature
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return time.Time{}, ErrMalformedSignature
+	}
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-tolerance)) || signedAt.After(now.Add(tolerance)) {
+		return time.Time{}, ErrStaleSignature
+	}
+
+	for _, secret := range secrets {
+		expected := payloadMAC(secret, timestamp, payload)
+		for _, signature := range signatures {
+			if hmac.Equal(expected, signature) {
+				return signedAt, nil
+			}
+		}
+	}
+	return time.Time{}, ErrInvalidSignature
+}
+
+// ReplayCache remembers signatures until they are too old to be accepted anyway
+type ReplayCache struct {
+	ttl  time.Duration
+	seen map[string]time.Time
+	mux  *sync.Mutex
+}
+
+func NewReplayCache(ttl time.Duration) *ReplayCache {
+	return &ReplayCache{
+		ttl:  ttl,
+		seen: map[string]time.Time{},
+		mux:  &sync.Mutex{},
+	}
+}
+
+// Check records signature and returns ErrReplayedSignature if it was recorded before
+func (c *ReplayCache) Check(signature string, now time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for seen, expiresAt := range c.seen {
+		if now.After(expiresAt) {
+			delete(c.seen, seen)
+		}
+	}
+	if _, ok := c.seen[signature]; ok {
+		return ErrReplayedSignature
+	}
+	c.seen[signature] = now.Add(c.ttl)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text emails to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer that delivers through the given SMTP server,
+// authenticating only when a username is provided
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	var smtpAuth smtp.Auth
+	if username != "" {
+		smtpAuth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{
+		addr: host + ":" + port,
+		from: from,
+		auth: smtpAuth,
+	}
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+// LogMailer writes emails to a file instead of sending them, for local development.
+// An empty path logs emails to stdout
+type LogMailer struct {
+	path string
+	mux  *sync.Mutex
+}
+
+func NewLogMailer(path string) *LogMailer {
+	return &LogMailer{
+		path: path,
+		mux:  &sync.Mutex{},
+	}
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().UTC().Format(time.RFC1123Z), to, subject, body)
+	if m.path == "" {
+		log.Printf("Mail not sent, dev mailer in use:\n%s", msg)
+		return nil
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(msg)
+	return err
+}
+
+// newMailer uses SMTP when a host is configured and falls back to the dev mailer otherwise
+func newMailer(config *Config) Mailer {
+	if config.SMTPHost == "" {
+		return NewLogMailer(config.MailLog)
+	}
+	return NewSMTPMailer(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword, config.MailFrom)
+}
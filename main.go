@@ -2,83 +2,176 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/janmmiranda/chripy/internal/auth"
 	"github.com/joho/godotenv"
 )
 
-const filepathRoot = "."
-const port = "8080"
 const serverFailed = "Something went wrong"
 const filterWord = "****"
-const dbFilename = "database.json"
-
-var filterWords = []string{"kerfuffle", "sharbert", "fornax"}
+const webhookInterval = 5 * time.Second
 
 func main() {
+	// the environment can also be set in a .env file
 	err := godotenv.Load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("Error loading .env file: %s", err)
+	}
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		configCommand(args[1:])
+		return
+	}
+
+	flags := flag.NewFlagSet("chirpy", flag.ExitOnError)
+	dbg := flags.Bool("debug", false, "Enable debug mode")
+	config, err := LoadConfig(flags, args)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s", err)
+	}
+	auth.SetPasswordHasher(config.Argon2id())
+	auth.SetErrorWriter(respondWithAuthError)
+	passwordPolicy, err := config.PasswordPolicy()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatal(err)
 	}
-	secretKey := os.Getenv("JWT_SECRET")
-	polkaKey := os.Getenv("POLKA_KEY")
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
 	if *dbg {
-		DeleteDB(dbFilename)
+		DeleteDB(config.DBFilename)
 	}
 
-	db, err := NewDB(dbFilename)
+	db, err := NewDB(config.DBFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := auth.LoadKeySet(config.JWTKeysFile, config.JWTAlg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if config.AdminEmail != "" {
+		err = promoteAdmin(db, config.AdminEmail)
+		if err != nil {
+			log.Printf("Couldn't make %s an admin: %s", config.AdminEmail, err)
+		}
+	}
+	blobs, err := NewFileBlobStore(config.MediaRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// plain http and private addresses are only allowed for local receivers
+	webhooks := NewWebhookSender(db, config.WebhookAllowInsecure)
+
 	apiConfig := apiConfig{
-		fileServerHits: 0,
-		DB:             db,
-		JWTSecret:      secretKey,
-		PolkaKey:       polkaKey,
+		fileServerHits:      0,
+		DB:                  db,
+		Keys:                keys,
+		PasswordPolicy:      passwordPolicy,
+		PolkaKeys:           config.PolkaKeys,
+		PolkaReplays:        auth.NewReplayCache(2 * polkaSignatureTolerance),
+		Mailer:              newMailer(config),
+		ChirpDeletionPolicy: config.ChirpDeletionPolicy,
+		Blobs:               blobs,
+		ChirpUndoWindow:     config.ChirpUndoWindow,
+		SubscriptionTerms:   config.SubscriptionTerms,
+		AccessDuration:      config.AccessDuration,
+		RefreshDuration:     config.RefreshDuration,
+		FilterWords:         config.FilterWords,
+		Entitlements:        NewEntitlementService(db, defaultPlanEntitlements),
+		RateLimits:          NewRateLimiter(),
+		Webhooks:            webhooks,
 	}
+	go apiConfig.purgeDeletedChirps(time.Minute)
+	go apiConfig.expireSubscriptions(time.Minute)
+	go apiConfig.rotateKeys(config.JWTRotation)
+	go webhooks.Run(webhookInterval)
 
 	mux := http.NewServeMux()
-	mux.Handle("/app/*", apiConfig.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))))
+	mux.Handle("/app/*", apiConfig.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(config.FilepathRoot)))))
+	mux.Handle("GET "+mediaURLPrefix, http.StripPrefix(mediaURLPrefix, blobs))
 	mux.HandleFunc("GET /api/healthz", handlerHealth)
-	mux.HandleFunc("GET /admin/metrics", apiConfig.handlerMetrics)
-	mux.HandleFunc("GET /api/reset", apiConfig.handlerReset)
+	mux.HandleFunc("GET /.well-known/jwks.json", apiConfig.handlerJWKS)
+	mux.Handle("GET /admin/metrics", apiConfig.requireRole(RoleAdmin, apiConfig.handlerMetrics))
+	mux.Handle("GET /api/reset", apiConfig.requireRole(RoleAdmin, apiConfig.handlerReset))
+	mux.Handle("GET /admin/users", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminUsersGet))
+	mux.Handle("PUT /admin/users/{userID}/role", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminUsersRole))
+	mux.Handle("DELETE /admin/users/{userID}", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminUsersDelete))
+	mux.Handle("GET /admin/audit", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminAuditGet))
+	mux.Handle("GET /admin/webhooks", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminWebhooksGet))
+	mux.Handle("POST /admin/webhooks", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminWebhooksCreate))
+	mux.Handle("GET /admin/webhooks/polka", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminPolkaEventsGet))
+	mux.Handle("POST /admin/webhooks/polka/{eventID}/replay", apiConfig.requireRole(RoleAdmin, apiConfig.handlerAdminPolkaEventReplay))
 
-	mux.HandleFunc("POST /api/chirps", apiConfig.handlerChirpsCreate)
-	mux.HandleFunc("GET /api/chirps", apiConfig.handlerChirpsGet)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", apiConfig.handlerChirpGet)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiConfig.handlerChirpsDelete)
+	mux.Handle("POST /api/chirps", apiConfig.requireAuth(apiConfig.handlerChirpsCreate))
+	mux.Handle("GET /api/chirps", apiConfig.optionalAuth(apiConfig.handlerChirpsGet))
+	mux.Handle("GET /api/chirps/{chirpID}", apiConfig.optionalAuth(apiConfig.handlerChirpGet))
+	mux.Handle("PUT /api/chirps/{chirpID}", apiConfig.requireAuth(apiConfig.handlerChirpsUpdate))
+	mux.Handle("DELETE /api/chirps/{chirpID}", apiConfig.requireAuth(apiConfig.handlerChirpsDelete))
+	mux.Handle("POST /api/chirps/{chirpID}/restore", apiConfig.requireAuth(apiConfig.handlerChirpsRestore))
+
+	mux.Handle("POST /api/media", apiConfig.requireAuth(apiConfig.handlerMediaUpload))
+	mux.HandleFunc("GET /api/media/{mediaID}", apiConfig.handlerMediaGet)
 
 	mux.HandleFunc("POST /api/users", apiConfig.handlerUsersCreate)
 	mux.HandleFunc("POST /api/login", apiConfig.handlerUsersLogin)
-	mux.HandleFunc("PUT /api/users", apiConfig.handlerUsersUpdate)
+	mux.HandleFunc("POST /api/login/mfa", apiConfig.handlerLoginMFA)
+	mux.Handle("PUT /api/users", apiConfig.requireAuth(apiConfig.handlerUsersUpdate))
+	mux.Handle("PATCH /api/users", apiConfig.requireAuth(apiConfig.handlerUsersUpdate))
+	mux.Handle("DELETE /api/users", apiConfig.requireAuth(apiConfig.handlerUsersDelete))
+	mux.HandleFunc("POST /api/users/verify", apiConfig.handlerUsersVerify)
+	mux.Handle("POST /api/users/verify/resend", apiConfig.requireAuth(apiConfig.handlerUsersVerifyResend))
+	mux.Handle("GET /api/users/me", apiConfig.requireAuth(apiConfig.handlerUsersGetMe))
+	mux.Handle("POST /api/users/mfa/totp", apiConfig.requireAuth(apiConfig.handlerMFAEnroll))
+	mux.Handle("POST /api/users/mfa/totp/confirm", apiConfig.requireAuth(apiConfig.handlerMFAConfirm))
+	mux.Handle("DELETE /api/users/mfa/totp", apiConfig.requireAuth(apiConfig.handlerMFADisable))
+	mux.Handle("GET /api/users/me/export", apiConfig.requireAuth(apiConfig.handlerUsersExport))
+	mux.HandleFunc("GET /api/users/{handle}", apiConfig.handlerUsersGetByHandle)
+	mux.Handle("POST /api/users/{userID}/block", apiConfig.requireAuth(apiConfig.handlerUsersBlock))
+	mux.Handle("DELETE /api/users/{userID}/block", apiConfig.requireAuth(apiConfig.handlerUsersUnblock))
+	mux.Handle("POST /api/users/{userID}/mute", apiConfig.requireAuth(apiConfig.handlerUsersMute))
+	mux.Handle("DELETE /api/users/{userID}/mute", apiConfig.requireAuth(apiConfig.handlerUsersUnmute))
+
+	mux.HandleFunc("POST /api/password/forgot", apiConfig.handlerPasswordForgot)
+	mux.HandleFunc("POST /api/password/reset", apiConfig.handlerPasswordReset)
 
 	mux.HandleFunc("POST /api/refresh", apiConfig.handlerRefreshToken)
 	mux.HandleFunc("POST /api/revoke", apiConfig.handlerRevokeToken)
+	mux.Handle("GET /api/sessions", apiConfig.requireAuth(apiConfig.handlerSessionsGet))
+	mux.Handle("DELETE /api/sessions", apiConfig.requireAuth(apiConfig.handlerSessionsDeleteAll))
+	mux.Handle("DELETE /api/sessions/{sessionID}", apiConfig.requireAuth(apiConfig.handlerSessionsDelete))
+
+	mux.Handle("GET /api/webhooks", apiConfig.requireAuth(apiConfig.handlerWebhooksGet))
+	mux.Handle("POST /api/webhooks", apiConfig.requireAuth(apiConfig.handlerWebhooksCreate))
+	mux.Handle("DELETE /api/webhooks/{webhookID}", apiConfig.requireAuth(apiConfig.handlerWebhooksDelete))
+	mux.Handle("GET /api/webhooks/{webhookID}/deliveries", apiConfig.requireAuth(apiConfig.handlerWebhookDeliveriesGet))
 
 	mux.HandleFunc("POST /api/polka/webhooks", apiConfig.handlerPolkaWebhooks)
 
-	corsMux := middlewareLog(middlewareCors(mux))
+	corsMux := middlewareRequestID(middlewareLog(middlewareCors(mux)))
 
 	server := &http.Server{
-		Addr:    ":" + port,
+		Addr:    ":" + config.Port,
 		Handler: corsMux,
 	}
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
+	if len(config.PolkaKeys) == 0 {
+		log.Printf("POLKA_KEYS isn't set, Polka webhooks will be refused")
+	}
+	log.Printf("Serving files from %s on port: %s\n", config.FilepathRoot, config.Port)
 	log.Fatal(server.ListenAndServe())
 }
 
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -88,6 +181,71 @@ func middlewareCors(next http.Handler) http.Handler {
 	})
 }
 
+// purgeDeletedChirps permanently removes deleted chirps once they can no longer be restored
+func (cfg *apiConfig) purgeDeletedChirps(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := cfg.DB.PurgeDeletedChirps(cfg.ChirpUndoWindow)
+		if err != nil {
+			log.Printf("Couldn't purge deleted chirps: %s", err)
+		}
+	}
+}
+
+func (cfg *apiConfig) expireSubscriptions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := cfg.DB.ExpireSubscriptions()
+		if err != nil {
+			log.Printf("Couldn't expire subscriptions: %s", err)
+		}
+	}
+}
+
+// rotateKeys switches to a new signing key whenever the current one is older than
+// interval. Old keys are kept long enough to verify every token they signed,
+// the longest lived being verification tokens
+func (cfg *apiConfig) rotateKeys(interval time.Duration) {
+	retain := time.Duration(VerifyDuration) * time.Second
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		if cfg.Keys.SigningKeyAge() < interval {
+			continue
+		}
+		err := cfg.Keys.Rotate(retain)
+		if err != nil {
+			log.Printf("Couldn't rotate signing key: %s", err)
+			continue
+		}
+		log.Printf("Rotated token signing key")
+	}
+}
+
+// configCommand runs chirpy config print, which prints the configuration the
+// server would start with, secrets redacted
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: chirpy config print [flags]")
+		os.Exit(2)
+	}
+	config, err := LoadConfig(flag.NewFlagSet("chirpy config print", flag.ExitOnError), args[1:])
+	printErr := config.Print(os.Stdout)
+	if printErr != nil {
+		log.Fatal(printErr)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s", err)
+	}
+}
+
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, cfg.Keys.JWKS())
+}
+
 func handlerHealth(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -103,7 +261,7 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 
 func middlewareLog(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s", r.Method, r.URL.Path)
+		log.Printf("%s %s (request %s)", r.Method, r.URL.Path, r.Header.Get(requestIDHeader))
 		next.ServeHTTP(w, r)
 	})
 }
@@ -130,16 +288,10 @@ func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, req *http.Request) {
 	`, cfg.fileServerHits)))
 }
 
-func respondWithError(w http.ResponseWriter, code int, msg string) {
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
-	}
-	type errorResponse struct {
-		Error string `json:"error"`
-	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+// respondWithError responds with the generic error code for status. For server
+// errors msg is only logged
+func respondWithError(w http.ResponseWriter, status int, msg string) {
+	respondWithAPIError(w, newAPIError(status, "", msg))
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+// RateLimiter counts each user's requests in fixed one minute windows
+type RateLimiter struct {
+	windows map[int]rateWindow
+	mux     *sync.Mutex
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		windows: map[int]rateWindow{},
+		mux:     &sync.Mutex{},
+	}
+}
+
+// Allow counts a request by userID and reports whether it is within limit, along
+// with the requests left and when the window resets
+func (l *RateLimiter) Allow(userID int, limit int, now time.Time) (bool, int, time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	window, ok := l.windows[userID]
+	if !ok || now.Sub(window.start) >= time.Minute {
+		// windows that ended are dropped as new ones start, so idle users don't pile up
+		for id, w := range l.windows {
+			if now.Sub(w.start) >= time.Minute {
+				delete(l.windows, id)
+			}
+		}
+		window = rateWindow{start: now}
+	}
+	window.count++
+	l.windows[userID] = window
+	return window.count <= limit, max(limit-window.count, 0), window.start.Add(time.Minute)
+}
+
+// rateLimit limits authenticated requests to the RequestsPerMinute of the user's plan
+func (cfg *apiConfig) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		principal, ok := auth.PrincipalFromContext(req.Context())
+		if ok && !cfg.allowRequest(w, principal.UserID) {
+			return
+		}
+		next(w, req)
+	}
+}
+
+// allowRequest counts a request by the user and sets the rate limit headers.
+// Requests over the limit are answered with 429 and it returns false
+func (cfg *apiConfig) allowRequest(w http.ResponseWriter, userID int) bool {
+	entitlements, err := cfg.Entitlements.ForUser(userID)
+	if err != nil {
+		// the handler reports users that no longer exist
+		log.Printf("Couldn't load entitlements of user %v: %s", userID, err)
+		return true
+	}
+
+	now := time.Now()
+	allowed, remaining, reset := cfg.RateLimits.Allow(userID, entitlements.RequestsPerMinute, now)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(entitlements.RequestsPerMinute))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if !allowed {
+		cfg.Entitlements.Check(w, entitlements, CapHigherRateLimit)
+		w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+		respondWithAPIError(w, newAPIError(http.StatusTooManyRequests, CodeRateLimited, "too many requests, try again later"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+// requireAuth only calls next for requests with a valid access token of a
+// session that is still active, within the rate limit of the user's plan
+func (cfg *apiConfig) requireAuth(next http.HandlerFunc) http.Handler {
+	return auth.RequireAuth(cfg.Keys, auth.TypeAccess)(cfg.requireSession(cfg.rateLimit(next)))
+}
+
+// optionalAuth calls next for anonymous requests and requests with a valid access token
+func (cfg *apiConfig) optionalAuth(next http.HandlerFunc) http.Handler {
+	return auth.OptionalAuth(cfg.Keys, auth.TypeAccess)(cfg.requireSession(cfg.rateLimit(next)))
+}
+
+// requireSession refuses access tokens whose session was revoked by logging
+// out, a password reset or refresh token reuse, before they expire
+func (cfg *apiConfig) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		principal, ok := auth.PrincipalFromContext(req.Context())
+		if !ok {
+			next(w, req)
+			return
+		}
+		err := cfg.DB.CheckSession(principal.UserID, principal.SessionID)
+		if errors.Is(err, ErrSessionEnded) {
+			auth.Unauthorized(w, err)
+			return
+		}
+		if err != nil {
+			respondWithAPIError(w, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Detail: "couldn't check session", Cause: err})
+			return
+		}
+		next(w, req)
+	}
+}
+
+// requireRole only calls next for users whose role grants at least role. The
+// role is read from the database rather than the token, so demoting or
+// deleting a user takes effect before their access token expires
+func (cfg *apiConfig) requireRole(role string, next http.HandlerFunc) http.Handler {
+	return cfg.requireAuth(func(w http.ResponseWriter, req *http.Request) {
+		principal, ok := auth.PrincipalFromContext(req.Context())
+		if !ok {
+			auth.Forbidden(w, "requires the "+role+" role")
+			return
+		}
+		user, err := cfg.DB.GetUser(principal.UserID)
+		if err != nil {
+			respondWithAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Detail: "user no longer exists", Cause: err})
+			return
+		}
+		if !hasRole(user.Role, role) {
+			auth.Forbidden(w, "requires the "+role+" role")
+			return
+		}
+		principal.Role = user.Role
+		next(w, req.WithContext(auth.WithPrincipal(req.Context(), principal)))
+	})
+}
+
+// promoteAdmin gives the user with the given email the admin role at startup
+func promoteAdmin(db *DB, email string) error {
+	user, err := db.FindUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	_, err = db.SetRole(0, user.ID, RoleAdmin)
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+// accessToken starts a session for the user and returns an access token of
+// it that claims role
+func accessToken(t *testing.T, cfg *apiConfig, userID int, role string) string {
+	t.Helper()
+	session := startTestSession(t, cfg.DB, userID, fmt.Sprintf("refresh-%d-%s", userID, role))
+	token, err := auth.IssueJWT(userID, cfg.Keys, time.Minute, auth.Claims{Type: auth.TypeAccess, Role: role, SessionID: session.ID})
+	if err != nil {
+		t.Fatalf("IssueJWT: %v", err)
+	}
+	return token
+}
+
+func TestRequireRoleChecksCurrentRole(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	admin := createTestUser(t, cfg.DB, "walt@example.com")
+	demoted := createTestUser(t, cfg.DB, "jesse@example.com")
+	deleted := createTestUser(t, cfg.DB, "gus@example.com")
+	if _, err := cfg.DB.SetRole(0, admin.ID, RoleAdmin); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	tokens := map[int]string{
+		admin.ID:   accessToken(t, cfg, admin.ID, RoleUser),
+		demoted.ID: accessToken(t, cfg, demoted.ID, RoleAdmin),
+		deleted.ID: accessToken(t, cfg, deleted.ID, RoleAdmin),
+	}
+	if _, err := cfg.DB.DeleteUser(deleted.ID, false); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	var gotRole string
+	handler := cfg.requireRole(RoleAdmin, func(w http.ResponseWriter, req *http.Request) {
+		principal, _ := auth.PrincipalFromContext(req.Context())
+		gotRole = principal.Role
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name   string
+		userID int
+		want   int
+	}{
+		{name: "admin with an old user token", userID: admin.ID, want: http.StatusNoContent},
+		{name: "demoted since the token was issued", userID: demoted.ID, want: http.StatusForbidden},
+		{name: "deleted since the token was issued", userID: deleted.ID, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+			req.Header.Set("Authorization", "Bearer "+tokens[tt.userID])
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+	if gotRole != RoleAdmin {
+		t.Errorf("handler saw role %q, want the current role %q", gotRole, RoleAdmin)
+	}
+}
+
+func TestDeleteChirpChecksCurrentRole(t *testing.T) {
+	db := newTestDB(t)
+	author := createTestUser(t, db, "walt@example.com")
+	moderator := createTestUser(t, db, "jesse@example.com")
+	chirp, err := db.CreateChirp("say my name", author.ID, nil)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+
+	if err := db.DeleteChirp(chirp.ID, moderator.ID); err == nil {
+		t.Fatal("a user deleted someone else's chirp")
+	}
+	if _, err := db.SetRole(0, moderator.ID, RoleModerator); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	if err := db.DeleteChirp(chirp.ID, moderator.ID); err != nil {
+		t.Errorf("moderator couldn't delete a chirp: %v", err)
+	}
+}
+
+func TestAuthErrorsAreProblemDetails(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	handler := cfg.requireAuth(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/me", nil)
+	rec := httptest.NewRecorder()
+	rec.Header().Set(requestIDHeader, "request-1")
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", got)
+	}
+	var problem struct {
+		Code      string `json:"code"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("malformed problem %s: %v", rec.Body, err)
+	}
+	if problem.Code != CodeUnauthorized || problem.RequestID != "request-1" {
+		t.Errorf("problem = %+v, want code %q and the request ID", problem, CodeUnauthorized)
+	}
+}
+
+func TestRequireAuthRejectsEndedSessions(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg.DB, "walt@example.com")
+	handler := cfg.requireAuth(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	token := accessToken(t, cfg, user.ID, RoleUser)
+	if got := request(token); got != http.StatusNoContent {
+		t.Fatalf("active session: got %d, want %d", got, http.StatusNoContent)
+	}
+	if err := cfg.DB.RevokeSessions(user.ID); err != nil {
+		t.Fatalf("RevokeSessions: %v", err)
+	}
+	if got := request(token); got != http.StatusUnauthorized {
+		t.Errorf("revoked session: got %d, want %d", got, http.StatusUnauthorized)
+	}
+
+	noSession, err := auth.MakeJWT(user.ID, cfg.Keys, time.Minute, auth.TypeAccess, RoleUser)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	if got := request(noSession); got != http.StatusUnauthorized {
+		t.Errorf("token without a session: got %d, want %d", got, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const maxRequestBodySize = 1 << 20
+const maxEmailLength = 254
+
+// Validation rules, reported in FieldError.Rule
+const RuleRequired = "required"
+const RuleFormat = "format"
+const RuleType = "type"
+const RuleUnknown = "unknown"
+const RuleTooLong = "too_long"
+const RuleInvalid = "invalid"
+
+// FieldError is one problem with one field of a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// fieldErrors collects everything wrong with a request so it can be reported at once
+type fieldErrors []FieldError
+
+func (errs *fieldErrors) add(field, rule, message string) {
+	*errs = append(*errs, FieldError{
+		Field:   field,
+		Rule:    rule,
+		Message: message,
+	})
+}
+
+func (errs *fieldErrors) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		errs.add(field, RuleRequired, fmt.Sprintf("%s is required", field))
+		return false
+	}
+	return true
+}
+
+func (errs *fieldErrors) maxLength(field, value string, max int) {
+	if len(value) > max {
+		errs.add(field, RuleTooLong, fmt.Sprintf("%s must be at most %d characters", field, max))
+	}
+}
+
+func (errs *fieldErrors) email(field, value string) {
+	if !errs.required(field, value) {
+		return
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value || len(value) > maxEmailLength {
+		errs.add(field, RuleFormat, fmt.Sprintf("%s must be an email address", field))
+	}
+}
+
+// password checks a new password against the password policy
+func (errs *fieldErrors) password(policy auth.PasswordPolicy, field, value, email string) {
+	for _, violation := range policy.Check(value, email) {
+		errs.add(field, violation.Rule, violation.Message)
+	}
+}
+
+// ok responds with 422 and every field error, and reports whether there were none
+func (errs fieldErrors) ok(w http.ResponseWriter) bool {
+	if len(errs) == 0 {
+		return true
+	}
+	respondWithFieldErrors(w, errs)
+	return false
+}
+
+func respondWithFieldErrors(w http.ResponseWriter, errs []FieldError) {
+	respondWithAPIError(w, &APIError{
+		Status: http.StatusUnprocessableEntity,
+		Code:   CodeValidationFailed,
+		Detail: "request is invalid",
+		Fields: errs,
+	})
+}
+
+// decodeJSON strictly decodes a JSON object of at most maxRequestBodySize into
+// dst, responding with the reason and returning false when it can't
+func decodeJSON(w http.ResponseWriter, req *http.Request, dst interface{}) bool {
+	return decodeJSONObject(w, req, dst, true)
+}
+
+// decodeLenientJSON is decodeJSON ignoring fields dst doesn't have, for bodies
+// written by other services that may add fields at any time
+func decodeLenientJSON(w http.ResponseWriter, req *http.Request, dst interface{}) bool {
+	return decodeJSONObject(w, req, dst, false)
+}
+
+func decodeJSONObject(w http.ResponseWriter, req *http.Request, dst interface{}, strict bool) bool {
+	req.Body = http.MaxBytesReader(w, req.Body, maxRequestBodySize)
+	decoder := json.NewDecoder(req.Body)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(dst)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "request body must be a single JSON object")
+		return false
+	}
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		respondWithError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+	case errors.Is(err, io.EOF):
+		respondWithError(w, http.StatusBadRequest, "request body is empty")
+	case errors.As(err, &syntaxErr):
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("request body is not valid JSON at offset %d", syntaxErr.Offset))
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		respondWithError(w, http.StatusBadRequest, "request body is not valid JSON")
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		respondWithFieldErrors(w, []FieldError{{
+			Field:   field,
+			Rule:    RuleType,
+			Message: fmt.Sprintf("%s must be a %s", field, jsonTypeName(typeErr.Type.Kind().String())),
+		}})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		respondWithFieldErrors(w, []FieldError{{
+			Field:   field,
+			Rule:    RuleUnknown,
+			Message: fmt.Sprintf("%s is not a known field", field),
+		}})
+	default:
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+	}
+	return false
+}
+
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "bool":
+		return "boolean"
+	case kind == "slice", kind == "array":
+		return "list"
+	case kind == "struct", kind == "map":
+		return "object"
+	default:
+		return kind
+	}
+}
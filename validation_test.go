@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+func decodeTestBody(body string, strict bool) (*httptest.ResponseRecorder, parameters, bool) {
+	req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	params := parameters{}
+	if strict {
+		return rec, params, decodeJSON(rec, req, &params)
+	}
+	return rec, params, decodeLenientJSON(rec, req, &params)
+}
+
+func problemFields(t *testing.T, rec *httptest.ResponseRecorder) []FieldError {
+	t.Helper()
+	var problem struct {
+		Code   string       `json:"code"`
+		Fields []FieldError `json:"fields"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("malformed problem %s: %v", rec.Body, err)
+	}
+	if problem.Code != CodeValidationFailed {
+		t.Errorf("code = %q, want %q", problem.Code, CodeValidationFailed)
+	}
+	return problem.Fields
+}
+
+func TestDecodeJSONFieldErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want FieldError
+	}{
+		{
+			name: "unknown field",
+			body: `{"email": "walt@example.com", "pasword": "say-my-name-2008"}`,
+			want: FieldError{Field: "pasword", Rule: RuleUnknown, Message: "pasword is not a known field"},
+		},
+		{
+			name: "wrong type",
+			body: `{"email": "walt@example.com", "password": 2008}`,
+			want: FieldError{Field: "password", Rule: RuleType, Message: "password must be a string"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _, ok := decodeTestBody(tt.body, true)
+			if ok {
+				t.Fatal("decodeJSON accepted the body")
+			}
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+			}
+			if fields := problemFields(t, rec); !reflect.DeepEqual(fields, []FieldError{tt.want}) {
+				t.Errorf("fields = %+v, want %+v", fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONMalformedBodies(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "empty", body: "", want: http.StatusBadRequest},
+		{name: "invalid JSON", body: `{"email": }`, want: http.StatusBadRequest},
+		{name: "truncated", body: `{"email": "walt@example.com"`, want: http.StatusBadRequest},
+		{name: "two objects", body: `{} {}`, want: http.StatusBadRequest},
+		{name: "too large", body: `{"email": "` + strings.Repeat("a", maxRequestBodySize) + `"}`, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _, ok := decodeTestBody(tt.body, true)
+			if ok {
+				t.Fatal("decodeJSON accepted the body")
+			}
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestDecodeLenientJSONIgnoresUnknownFields(t *testing.T) {
+	rec, params, ok := decodeTestBody(`{"email": "walt@example.com", "referrer": "polka"}`, false)
+	if !ok {
+		t.Fatalf("decodeLenientJSON rejected the body with %d: %s", rec.Code, rec.Body)
+	}
+	if params.Email != "walt@example.com" {
+		t.Errorf("email = %q, want walt@example.com", params.Email)
+	}
+	if rec, _, ok := decodeTestBody(`{"email": 2008}`, false); ok || rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("decodeLenientJSON of a field with the wrong type: got %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestUsersCreateReportsEveryFieldError(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.PasswordPolicy = auth.DefaultPasswordPolicy
+	rec := httptest.NewRecorder()
+	cfg.handlerUsersCreate(rec, httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(`{"email": "walt", "password": "Xq9!"}`)))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+	}
+	fields := map[string]string{}
+	for _, field := range problemFields(t, rec) {
+		fields[field.Field] = field.Rule
+	}
+	if fields["email"] != RuleFormat || fields["password"] != auth.RuleMinLength {
+		t.Errorf("fields broke %v, want email %q and password %q", fields, RuleFormat, auth.RuleMinLength)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/janmmiranda/chripy/internal/auth"
+)
+
+const webhookTimeout = 10 * time.Second
+const webhookMaxAttempts = 8
+const webhookBaseBackoff = 30 * time.Second
+const webhookMaxBackoff = time.Hour
+const webhookRetention = 7 * 24 * time.Hour
+const webhookSignatureHeader = "Chirpy-Signature"
+
+var ErrWebhookAddress = errors.New("webhook address is not allowed")
+
+// WebhookSender posts queued deliveries to their webhooks
+type WebhookSender struct {
+	db     *DB
+	client *http.Client
+	// allowInsecure permits plain http and private addresses, for local development
+	allowInsecure bool
+}
+
+func NewWebhookSender(db *DB, allowInsecure bool) *WebhookSender {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+	}
+	if !allowInsecure {
+		dialer.Control = refusePrivateAddress
+	}
+	return newWebhookSender(db, allowInsecure, dialer.DialContext)
+}
+
+// newWebhookSender sends deliveries over the connections dial makes, which
+// tests point at their own servers
+func newWebhookSender(db *DB, allowInsecure bool, dial func(ctx context.Context, network, address string) (net.Conn, error)) *WebhookSender {
+	return &WebhookSender{
+		db: db,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			Transport: &http.Transport{
+				DialContext: dial,
+			},
+			// a redirect could lead to an address that wasn't checked on registration
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		allowInsecure: allowInsecure,
+	}
+}
+
+// CheckURL reports whether rawURL may be registered as a webhook
+func (s *WebhookSender) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.User != nil {
+		return ErrWebhookAddress
+	}
+	if u.Scheme != "https" && !(s.allowInsecure && u.Scheme == "http") {
+		return ErrWebhookAddress
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !s.allowInsecure && !publicIP(ip) {
+		return ErrWebhookAddress
+	}
+	return nil
+}
+
+// refusePrivateAddress stops deliveries from reaching the server's own network,
+// checked when connecting so DNS can't be changed to point there afterwards
+func refusePrivateAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrWebhookAddress, host)
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsMulticast()
+}
+
+// Run sends due deliveries every interval
+func (s *WebhookSender) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		deliveries, err := s.db.DueWebhookDeliveries(time.Now())
+		if err != nil {
+			log.Printf("Couldn't load webhook deliveries: %s", err)
+			continue
+		}
+		for _, delivery := range deliveries {
+			s.attempt(delivery)
+		}
+		err = s.db.PruneWebhookDeliveries(webhookRetention)
+		if err != nil {
+			log.Printf("Couldn't prune webhook deliveries: %s", err)
+		}
+	}
+}
+
+// attempt sends a delivery once and schedules a retry with exponential backoff if
+// it wasn't accepted. Deliveries are given up after webhookMaxAttempts
+func (s *WebhookSender) attempt(delivery WebhookDelivery) {
+	hook, err := s.db.GetWebhook(delivery.WebhookID, 0)
+	if errors.Is(err, ErrWebhookNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Couldn't load webhook %s: %s", delivery.WebhookID, err)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.ResponseStatus, err = s.send(hook, delivery)
+	now := time.Now().UTC()
+	switch {
+	case err == nil:
+		delivery.Status = DeliverySucceeded
+		delivery.LastError = ""
+		delivery.CompletedAt = &now
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.LastError = err.Error()
+		delivery.CompletedAt = &now
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts))
+	}
+
+	err = s.db.RecordWebhookAttempt(delivery)
+	if err != nil {
+		log.Printf("Couldn't record webhook delivery %s: %s", delivery.ID, err)
+	}
+}
+
+// send posts the delivery's payload and returns the response status, succeeding on any 2XX
+func (s *WebhookSender) send(hook Webhook, delivery WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks")
+	req.Header.Set("Chirpy-Event", delivery.Event)
+	req.Header.Set("Chirpy-Delivery", delivery.ID)
+	req.Header.Set(webhookSignatureHeader, auth.SignPayload(hook.Secret, time.Now(), delivery.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff doubles the wait after each failed attempt, with up to 20% jitter
+// so deliveries to an endpoint that was down don't all retry at once
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff << (attempts - 1)
+	if backoff > webhookMaxBackoff || backoff <= 0 {
+		backoff = webhookMaxBackoff
+	}
+	return backoff + rand.N(backoff/5)
+}